@@ -4,9 +4,11 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 
 	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/jwt"
 )
 
 // Define a custom contextKey type
@@ -15,6 +17,18 @@ type contextKey string
 // make user a key
 const userContextKey = contextKey("user")
 
+// make the bearer token a key
+const tokenContextKey = contextKey("token")
+
+// make the claims of a JWT a key
+const claimsContextKey = contextKey("claims")
+
+// make the API key a key
+const apiKeyContextKey = contextKey("apiKey")
+
+// make the resolved client IP address a key
+const clientIPContextKey = contextKey("clientIP")
+
 // Method to add user to the context
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -28,4 +42,61 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 		panic("missing user value in request context")
 	}
 	return user
-}
\ No newline at end of file
+}
+
+// Method to add the bearer token that authenticated the request to the context
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the bearer token, or an empty string for an anonymous request
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// Method to add the claims of a verified JWT to the context
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the JWT claims, or nil when the request was not authenticated by a JWT.
+// A user built from claims only has its ID, Activated and TimeZone fields set,
+// as they were when the token was issued
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+// Method to add the API key that authenticated the request to the context
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the API key, or nil when the request was not authenticated by one
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// Method to add the client IP address to the context
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// Retrieve the client IP address. Before the realIP middleware has run this
+// is just the address of the peer
+func (app *application) contextGetClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
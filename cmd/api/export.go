@@ -0,0 +1,184 @@
+// Filename: cmd/api/export.go
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fitness.zioncastillo.net/internal/data"
+)
+
+// exportCurrentUserHandler sends the authenticated user a ZIP archive holding
+// their profile and every fitness record, increment and goal, each as JSON and CSV
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	records, err := app.models.Fitness.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	steps, err := app.models.Increments.GetStepsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	cups, err := app.models.Increments.GetCupsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	goals, err := app.models.Goals.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// One CSV row per item, in the same order as the header
+	profileRows := [][]string{{
+		strconv.FormatInt(user.ID, 10),
+		user.CreatedAt.Format(time.RFC3339),
+		user.Name,
+		user.Email,
+		strconv.FormatBool(user.Activated),
+		formatOptionalFloat(user.HeightCM),
+		formatOptionalFloat(user.WeightKG),
+		formatOptionalString(user.BirthDate),
+		user.TimeZone,
+		user.Units,
+	}}
+	var recordRows [][]string
+	for _, record := range records {
+		recordRows = append(recordRows, []string{
+			strconv.Itoa(record.ID),
+			record.LocalDate,
+			record.Date.Format(time.RFC3339),
+			strconv.Itoa(record.Steps),
+			strconv.Itoa(record.Cups),
+			strconv.Itoa(record.Version),
+		})
+	}
+	var stepsRows [][]string
+	for _, increment := range steps {
+		stepsRows = append(stepsRows, []string{
+			strconv.FormatInt(increment.ID, 10),
+			increment.CreatedAt.Format(time.RFC3339),
+			strconv.Itoa(increment.Steps),
+		})
+	}
+	var cupsRows [][]string
+	for _, increment := range cups {
+		cupsRows = append(cupsRows, []string{
+			strconv.FormatInt(increment.ID, 10),
+			increment.CreatedAt.Format(time.RFC3339),
+			strconv.Itoa(increment.Cups),
+		})
+	}
+	var goalRows [][]string
+	for _, goal := range goals {
+		goalRows = append(goalRows, []string{
+			strconv.FormatInt(goal.ID, 10),
+			goal.EffectiveFrom,
+			strconv.Itoa(goal.Steps),
+			strconv.Itoa(goal.Cups),
+			goal.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	files := []struct {
+		name   string
+		value  interface{}
+		header []string
+		rows   [][]string
+	}{
+		{"profile", user, []string{"id", "created_at", "name", "email", "activated", "height_cm", "weight_kg", "birth_date", "time_zone", "units"}, profileRows},
+		{"dailyfitness", records, []string{"id", "local_date", "date", "steps", "cups", "version"}, recordRows},
+		{"tempsteps", steps, []string{"id", "created_at", "steps"}, stepsRows},
+		{"tempcups", cups, []string{"id", "created_at", "cups"}, cupsRows},
+		{"goals", goals, []string{"id", "effective_from", "steps", "cups", "created_at"}, goalRows},
+	}
+
+	// Build the whole archive before writing anything, so that a failure can
+	// still be reported as a JSON error
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.value, "", "\t")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = writeZipFile(zw, file.name+".json", js)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		f, err := zw.Create(file.name + ".csv")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		cw := csv.NewWriter(f)
+		cw.Write(file.header)
+		cw.WriteAll(file.rows)
+		if err := cw.Error(); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("fitness-export-%d-%s.zip", user.ID, time.Now().UTC().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// The writeZipFile() function adds a file holding contents to the archive
+func writeZipFile(zw *zip.Writer, name string, contents []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	return err
+}
+
+// The formatOptionalFloat() function formats a nullable number for a CSV cell
+func formatOptionalFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// The formatOptionalString() function formats a nullable string for a CSV cell
+func formatOptionalString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
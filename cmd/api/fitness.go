@@ -3,20 +3,23 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"time"
 	"net/http"
 
 	"fitness.zioncastillo.net/internal/data"
 	"fitness.zioncastillo.net/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
 func (app* application) saveFitnessHandler(w http.ResponseWriter, r *http.Request) {
 
 	var input struct{
-		UserId  int     `json:"user_id"`
 		Steps   int     `json:"steps"`
 		Cups    int     `json:"cups"`	
+		Date    string  `json:"date"`
+		Mode    string  `json:"mode"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -25,30 +28,114 @@ func (app* application) saveFitnessHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	//The record always belongs to the authenticated user
+	user := app.contextGetUser(r)
+
 	//Copy the values from the input struct to a new fitness struct
+	fitness := &data.Fitness{
+		User_id: user.ID,
+		Steps: input.Steps,
+		Cups: input.Cups,
+		LocalDate: input.Date,
+	}
+
+	v := validator.New()
+	location := app.userLocation(r, user, v)
+
+	app.insertFitness(w, r, fitness, input.Mode, location, v)
+}
+
+// adminSaveFitnessHandler lets an admin create a record on behalf of any user
+func (app *application) adminSaveFitnessHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct{
+		UserId  int64   `json:"user_id"`
+		Steps   int     `json:"steps"`
+		Cups    int     `json:"cups"`	
+		Date    string  `json:"date"`
+		Mode    string  `json:"mode"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
 	fitness := &data.Fitness{
 		User_id: input.UserId,
 		Steps: input.Steps,
 		Cups: input.Cups,
+		LocalDate: input.Date,
 	}
 
-	//Initialize a new Vaalidator instance
 	v := validator.New()
+	v.Check(input.UserId > 0, "user_id", "must be provided")
+
+	//Without a date the record is for today in the owner's time zone
+	location := time.UTC
+	if input.UserId > 0 {
+		owner, err := app.models.Users.Get(input.UserId)
+		switch {
+		case err == nil:
+			location = app.userLocation(r, owner, v)
+		case errors.Is(err, data.ErrRecordNotFound):
+			//Upsert reports the unknown user
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.insertFitness(w, r, fitness, input.Mode, location, v)
+}
+
+// insertFitness validates and stores the record for a day and writes the
+// response. The mode decides what happens when the day already has a record:
+// "create" fails with a conflict, "replace" overwrites the day and "add" adds
+// to it. Replacing is the default so that a client retry is harmless. A
+// record without a date is for today in the given location
+func (app *application) insertFitness(w http.ResponseWriter, r *http.Request, fitness *data.Fitness, mode string, location *time.Location, v *validator.Validator) {
+	if fitness.LocalDate == "" {
+		fitness.LocalDate = time.Now().In(location).Format("2006-01-02")
+	}
+	if mode == "" {
+		mode = data.UpsertReplace
+	}
 
 	//Check the map to determine if there were any validation errors
+	data.ValidateUpsertMode(v, mode)
 	if data.ValidateItem(v, fitness); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Fitness.Insert(fitness)
+	created, err := app.models.Fitness.Upsert(fitness, mode)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrUnknownUser):
+			v.AddError("user_id", "must belong to an existing user")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateRecord):
+			app.duplicateRecordResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//An existing day was updated rather than created
+	if !created {
+		err = app.writeJSON(w, http.StatusOK, envelope{"fitness": fitness}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
 	//Create a Location header for the newly create resource/
 	header := make(http.Header)
-	header.Set("Location", fmt.Sprintf("/v1/fitness/%d", fitness.ID))
+	header.Set("Location", fmt.Sprintf("/v1/records/%d", fitness.ID))
 	//Write the JSON response with 201 - Created status code with the body
 	//Being the fitness data and the header being the headers map
 	err = app.writeJSON(w, http.StatusCreated, envelope{"fitness": fitness}, header)
@@ -58,27 +145,53 @@ func (app* application) saveFitnessHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) listFitnessHandler(w http.ResponseWriter, r *http.Request) {
+	//Users may only list their own records
+	user := app.contextGetUser(r)
+	app.listFitness(w, r, user.ID, validator.New())
+}
+
+// adminListFitnessHandler lists the records of every user, or of the single
+// user named by the user_id query parameter
+func (app *application) adminListFitnessHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	userID := app.readInt(r.URL.Query(), "user_id", 0, v)
+	app.listFitness(w, r, int64(userID), v)
+}
+
+// listFitness reads the filters from the query string and writes the records
+// of the given user. A userID of 0 lists the records of every user
+func (app *application) listFitness(w http.ResponseWriter, r *http.Request, userID int64, v *validator.Validator) {
 
 	//Create input struct to hold our query Parameters
 	var input struct {
-			ID	    int
-			UserId  int
-			Steps   int
-			Cups    int
-			Date 	time.Time
+			data.FitnessQuery
 			data.Filters
 	}
 
-	//Initialize a validator
-	v := validator.New()
-
 	qf := r.URL.Query()
 
 	//Use the helper methods to extract the values
 	input.ID = app.readInt(qf, "id", 0, v)
-	input.UserId = app.readInt(qf, "user_id", 0, v)
-	input.Steps = app.readInt(qf, "steps", 0, v)
-	input.Cups = app.readInt(qf, "cups", 0, v)
+	input.UserID = userID
+	input.Steps = app.readOptionalInt(qf, "steps", v)
+	input.StepsMin = app.readOptionalInt(qf, "steps_min", v)
+	input.StepsMax = app.readOptionalInt(qf, "steps_max", v)
+	input.Cups = app.readOptionalInt(qf, "cups", v)
+	input.CupsMin = app.readOptionalInt(qf, "cups_min", v)
+	input.CupsMax = app.readOptionalInt(qf, "cups_max", v)
+
+	//A single date is shorthand for a range covering that one day
+	date := app.readDate(qf, "date", time.Time{}, v)
+	from := app.readDate(qf, "from", date, v)
+	to := app.readDate(qf, "to", date, v)
+	if !from.IsZero() {
+		input.From = &from
+	}
+	if !to.IsZero() {
+		//Both ends of the range are inclusive, so stop at the next midnight
+		end := to.AddDate(0, 0, 1)
+		input.To = &end
+	}
 
 	//Get the page information
 	input.Filters.Page = app.readInt(qf, "page", 1, v)
@@ -87,17 +200,23 @@ func (app *application) listFitnessHandler(w http.ResponseWriter, r *http.Reques
 	//Get the page information
 	input.Filters.Sort = app.readString(qf, "sort", "id")
 
+	//Sending a cursor parameter, even an empty one, switches to keyset pagination
+	_, input.Filters.CursorMode = qf["cursor"]
+	input.Filters.Cursor = app.readString(qf, "cursor", "")
+	input.Filters.CursorKey = []byte(app.config.cursor.secret)
+
 	//Specify the allowed sort values
 	input.Filters.SortList = []string{"id", "user_id", "steps", "cups", "date", "-id", "-user_id", "-steps", "-cups", "-date"}
 
 	//Check for validation errors
+	data.ValidateFitnessQuery(v, input.FitnessQuery)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	//Get a listing of all fitness records
-	lists, metadata, err := app.models.Fitness.GetAll(input.ID, input.UserId, input.Steps, input.Cups, input.Date, input.Filters)
+	lists, metadata, err := app.models.Fitness.GetAll(input.FitnessQuery, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -109,4 +228,223 @@ func (app *application) listFitnessHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-}
\ No newline at end of file
+}
+
+// statsFitnessHandler returns daily, weekly or monthly totals and averages of
+// the authenticated user's steps and cups. The buckets and the from and to
+// dates follow the local date each record was stored under, so the request
+// takes no time zone
+func (app *application) statsFitnessHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Period   string
+		From     *time.Time
+		To       *time.Time
+	}
+
+	v := validator.New()
+
+	qf := r.URL.Query()
+
+	user := app.contextGetUser(r)
+
+	input.Period = app.readString(qf, "period", "day")
+
+	from := app.readDate(qf, "from", time.Time{}, v)
+	to := app.readDate(qf, "to", time.Time{}, v)
+	if !from.IsZero() {
+		input.From = &from
+	}
+	if !to.IsZero() {
+		//The to date is inclusive, so stop at the following day
+		end := to.AddDate(0, 0, 1)
+		input.To = &end
+	}
+
+	data.ValidateStatsPeriod(v, input.Period)
+	if input.From != nil && input.To != nil {
+		v.Check(input.From.Before(*input.To), "to", "must not be before from")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stats, err := app.models.Fitness.GetStats(user.ID, input.Period, input.From, input.To)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"period": input.Period, "stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// httprouter does not allow the static /v1/records/show route to live beside
+// the /v1/records/:id wildcard, so GET requests under /v1/records/ are
+// dispatched here based on the final path segment
+func (app *application) recordsGetHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	switch params.ByName("id") {
+	case "show":
+		app.listFitnessHandler(w, r)
+	case "stats":
+		app.statsFitnessHandler(w, r)
+	case "today":
+		app.todayTotalHandler(w, r)
+	default:
+		app.showFitnessHandler(w, r)
+	}
+}
+
+func (app *application) showFitnessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	//Fetch the specific fitness record
+	fitness, err := app.getFitnessForUser(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Write the data returned by Get()
+	err = app.writeJSON(w, http.StatusOK, envelope{"fitness": fitness}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateFitnessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	//Fetch the original record from the database
+	fitness, err := app.getFitnessForUser(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Pointers let us tell a missing field apart from a zero value
+	var input struct {
+		Steps   *int    `json:"steps"`
+		Cups    *int    `json:"cups"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//Only copy over the fields that were supplied
+	if input.Steps != nil {
+		fitness.Steps = *input.Steps
+	}
+	if input.Cups != nil {
+		fitness.Cups = *input.Cups
+	}
+
+	v := validator.New()
+
+	if data.ValidateItem(v, fitness); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Pass the updated record to Update()
+	err = app.models.Fitness.Update(fitness)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"fitness": fitness}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteFitnessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	//Make sure the user is allowed to see the record before deleting it
+	_, err = app.getFitnessForUser(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	//Delete the record from the database
+	err = app.models.Fitness.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "record successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getFitnessForUser() fetches a record for the authenticated user. Records that
+// belong to someone else are reported as not found unless the user holds the
+// dailyfitness:admin permission
+func (app *application) getFitnessForUser(r *http.Request, id int64) (*data.Fitness, error) {
+	fitness, err := app.models.Fitness.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	user := app.contextGetUser(r)
+	if fitness.User_id == user.ID {
+		return fitness, nil
+	}
+
+	permissions, err := app.userPermissions(r, user)
+	if err != nil {
+		return nil, err
+	}
+	if !permissions.Include("dailyfitness:admin") {
+		return nil, data.ErrRecordNotFound
+	}
+	return fitness, nil
+}
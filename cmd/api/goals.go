@@ -0,0 +1,134 @@
+// Filename: cmd/api/goals.go
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/validator"
+)
+
+// setGoalHandler sets the authenticated user's daily goal from a given date
+func (app *application) setGoalHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Steps         int    `json:"steps"`
+		Cups          int    `json:"cups"`
+		EffectiveFrom string `json:"effective_from"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	goal := &data.Goal{
+		UserID:        user.ID,
+		Steps:         input.Steps,
+		Cups:          input.Cups,
+		EffectiveFrom: input.EffectiveFrom,
+	}
+
+	v := validator.New()
+
+	// Without a date the goal starts today in the user's time zone
+	today := time.Now().In(app.userLocation(r, user, v)).Format("2006-01-02")
+	if goal.EffectiveFrom == "" {
+		goal.EffectiveFrom = today
+	}
+
+	// Perform validation
+	if data.ValidateGoal(v, goal, today); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Goals.Set(goal)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"goal": goal}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listGoalsHandler returns the history of the authenticated user's goals
+func (app *application) listGoalsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	goals, err := app.models.Goals.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"goals": goals}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// goalProgressHandler reports how close the authenticated user came to their
+// goals on each day between the from and to dates, the last week by default.
+// The default dates end on today in the user's time zone
+func (app *application) goalProgressHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	qf := r.URL.Query()
+
+	today := data.LocalDate(time.Now(), app.userLocation(r, user, v))
+	to := app.readDate(qf, "to", today, v)
+	from := app.readDate(qf, "from", to.AddDate(0, 0, -6), v)
+
+	v.Check(!to.Before(from), "to", "must not be before from")
+	v.Check(to.Sub(from) <= 366*24*time.Hour, "from", "must be at most a year before to")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	days, err := app.models.Goals.GetProgress(user.ID, from, to)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"progress": days}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// streaksHandler returns the authenticated user's current and longest runs of
+// days on which they met their goals. The user's time zone, or the tz query
+// parameter, decides which calendar day it is for the user
+func (app *application) streaksHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	location := app.userLocation(r, user, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	today := data.LocalDate(time.Now(), location)
+
+	streaks, err := app.models.Goals.GetStreaks(user.ID, today)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"streaks": streaks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
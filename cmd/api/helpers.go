@@ -11,7 +11,9 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"fitness.zioncastillo.net/internal/data"
 	"fitness.zioncastillo.net/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -73,6 +75,74 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return intValue
 }
 
+// The readOptionalInt() method works like readInt() but returns nil when the key
+// is missing, so that a zero value can still be used as a filter
+func (app *application) readOptionalInt(qs url.Values, key string, v *validator.Validator) *int {
+	// Get the value
+	value := qs.Get(key)
+	if value == "" {
+		return nil
+	}
+	// Perform the conversion to an integer
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return nil
+	}
+	return &intValue
+}
+
+// The readDate() method converts a YYYY-MM-DD value from the query string to a
+// time.Time at midnight UTC. If the value cannot be parsed then a validation
+// error is added to the validation errors map
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	// Get the value
+	value := qs.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+	// Perform the conversion to a date
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		v.AddError(key, "must be a date in the format YYYY-MM-DD")
+		return defaultValue
+	}
+	return date
+}
+
+// The readLocation() method loads the IANA time zone named in the query string,
+// such as "America/Belize". UTC is used when no time zone is given. If the name
+// is unknown then a validation error is added to the validation errors map
+func (app *application) readLocation(qs url.Values, key string, v *validator.Validator) *time.Location {
+	// Get the value
+	value := qs.Get(key)
+	if value == "" {
+		return time.UTC
+	}
+	// "Local" names the server's time zone, which clients know nothing about
+	location, err := time.LoadLocation(value)
+	if err != nil || value == "Local" {
+		v.AddError(key, "must be a valid time zone")
+		return time.UTC
+	}
+	return location
+}
+
+// The userLocation() method returns the time zone that the request's dates
+// are in: the zone named by the tz query string parameter when there is one,
+// otherwise the time zone saved on the user's profile
+func (app *application) userLocation(r *http.Request, user *data.User, v *validator.Validator) *time.Location {
+	qs := r.URL.Query()
+	if qs.Get("tz") != "" {
+		return app.readLocation(qs, "tz", v)
+	}
+	location, err := time.LoadLocation(user.TimeZone)
+	if err != nil || user.TimeZone == "Local" {
+		return time.UTC
+	}
+	return location
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	//Convert our map into a JSON object
 	js, err := json.MarshalIndent(data, "", "\t")
@@ -164,4 +234,34 @@ func (app *application) background(fn func()) {
 		// Execute fn()
 		fn()
 	}()
-}
\ No newline at end of file
+}
+
+// The schedule() helper runs fn in the background once every interval. A
+// tick is skipped while the previous run is still going, so slow runs never
+// pile up. The ticker Goroutine is tracked by the WaitGroup and stops when the
+// shutdown channel is closed, so serve() waits for it and any run in progress
+func (app *application) schedule(interval time.Duration, fn func()) {
+	running := make(chan struct{}, 1)
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case running <- struct{}{}:
+					app.background(func() {
+						defer func() { <-running }()
+						fn()
+					})
+				default:
+					// The previous run has not finished yet
+				}
+			case <-app.shutdown:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+// Filename: cmd/api/increments.go
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/validator"
+)
+
+// addStepsHandler logs a small number of steps for the authenticated user
+func (app *application) addStepsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Steps int `json:"steps"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateStepsIncrement(v, input.Steps); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	increment := &data.Increment{
+		UserID: user.ID,
+		Steps:  input.Steps,
+	}
+	err = app.models.Increments.InsertSteps(increment)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"increment": increment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addCupsHandler logs a small number of cups of water for the authenticated user
+func (app *application) addCupsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Cups int `json:"cups"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateCupsIncrement(v, input.Cups); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	increment := &data.Increment{
+		UserID: user.ID,
+		Cups:   input.Cups,
+	}
+	err = app.models.Increments.InsertCups(increment)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"increment": increment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// todayTotalHandler returns the running total of today's steps and cups,
+// including the increments that have not been rolled up yet
+func (app *application) todayTotalHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	location := app.userLocation(r, user, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Today runs from midnight to midnight in the user's time zone
+	now := time.Now().In(location)
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	end := start.AddDate(0, 0, 1)
+
+	total, err := app.models.Increments.GetTotal(user.ID, start, end)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"today": total}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// scheduleRollUp starts a Goroutine that rolls the increments of past days
+// up into the dailyfitness table once every interval until the server shuts down
+func (app *application) scheduleRollUp(interval time.Duration) {
+	app.schedule(interval, app.rollUpIncrements)
+}
+
+// rollUpIncrements consolidates every increment logged before today in the
+// time zone of its user
+func (app *application) rollUpIncrements() {
+	days, err := app.models.Increments.RollUp(time.Now())
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if days > 0 {
+		app.logger.PrintInfo("rolled up increments", map[string]string{
+			"records": strconv.Itoa(days),
+		})
+	}
+}
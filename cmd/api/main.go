@@ -2,18 +2,23 @@ package main
 
 import (
     "context"
+    "crypto/rand"
     "database/sql"
+    "encoding/hex"
+    "expvar"
     "flag"
     "fmt"
     "strings"
-    "net/http"
     "os"
     "sync"
     "time"
 
 	"fitness.zioncastillo.net/internal/data"
     "fitness.zioncastillo.net/internal/jsonlog"
+    "fitness.zioncastillo.net/internal/jwt"
     "fitness.zioncastillo.net/internal/mailer"
+    "fitness.zioncastillo.net/internal/ratelimit"
+    "fitness.zioncastillo.net/internal/realip"
     _ "github.com/lib/pq"
 )
 
@@ -41,6 +46,9 @@ type config struct {
 		rps     float64 // requests/second
 		burst   int
 		enabled bool
+		authRPS   float64 // requests/second on the login and token routes
+		authBurst int
+		store     string
 	}
     smtp struct {
         host     string
@@ -52,6 +60,37 @@ type config struct {
     cors struct {
 		trustedOrigins []string
 	}
+    proxies struct {
+        trusted []string
+        header  string
+    }
+    cursor struct {
+        secret string
+    }
+    rollup struct {
+        interval time.Duration
+    }
+    tokens struct {
+        accessTTL  time.Duration
+        refreshTTL time.Duration
+    }
+    jwt struct {
+        enabled    bool
+        keysDir    string
+        signingKID string
+    }
+    permissions struct {
+        cacheTTL time.Duration
+    }
+    accounts struct {
+        deletionGrace time.Duration
+        purgeInterval time.Duration
+    }
+    login struct {
+        maxFailures int
+        backoff     time.Duration
+        lockout     time.Duration
+    }
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
@@ -62,6 +101,10 @@ type application struct {
     logger *jsonlog.Logger
 	models data.Models
     mailer mailer.Mailer
+    jwtKeys *jwt.KeySet
+    limiter ratelimit.Store
+    proxies *realip.Resolver
+    shutdown chan struct{}
     wg sync.WaitGroup
 }
 
@@ -82,6 +125,9 @@ func main() {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.Float64Var(&cfg.limiter.authRPS, "limiter-auth-rps", 0.1, "Rate limiter maximum requests per second on login and token routes")
+	flag.IntVar(&cfg.limiter.authBurst, "limiter-auth-burst", 5, "Rate limiter maximum burst on login and token routes")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Rate limiter storage (memory|postgres)")
 
     flag.StringVar(&cfg.smtp.host, "smpt-host", "smtp.mailtrap.io", "SMPT host")
     flag.IntVar(&cfg.smtp.port, "smpt-port", 25, "SMPT port")
@@ -96,6 +142,40 @@ func main() {
 		return nil
 	})
 
+    // Forwarding headers are only believed from these proxies
+	flag.Func("trusted-proxies", "Trusted proxy IP addresses or CIDRs (space separated)", func(val string) error {
+		cfg.proxies.trusted = strings.Fields(val)
+		return nil
+	})
+    flag.StringVar(&cfg.proxies.header, "proxy-header", realip.HeaderXForwardedFor, "Forwarding header set by the trusted proxies (X-Forwarded-For|Forwarded)")
+
+    // How often the intraday increments are rolled up into daily records
+    flag.DurationVar(&cfg.rollup.interval, "rollup-interval", time.Hour, "Interval between roll-ups of the intraday increments")
+
+    // Lifetimes of the tokens issued by the refresh endpoint
+    flag.DurationVar(&cfg.tokens.accessTTL, "token-access-ttl", 15*time.Minute, "Lifetime of authentication tokens")
+    flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+    // Stateless JWT authentication tokens
+    flag.BoolVar(&cfg.jwt.enabled, "jwt-enabled", false, "Issue signed JWT authentication tokens")
+    flag.StringVar(&cfg.jwt.keysDir, "jwt-keys-dir", "./keys", "Directory holding the JWT keys (<kid>.hmac or <kid>.pem)")
+    flag.StringVar(&cfg.jwt.signingKID, "jwt-signing-kid", "", "Key id of the key that signs new JWTs")
+
+    // How long the effective permissions of a user are cached
+    flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", 30*time.Second, "Lifetime of cached user permissions (0 disables the cache)")
+
+    // Deleted accounts can be restored until they are purged
+    flag.DurationVar(&cfg.accounts.deletionGrace, "account-deletion-grace", 30*24*time.Hour, "Time a deleted account can be restored before it is purged")
+    flag.DurationVar(&cfg.accounts.purgeInterval, "account-purge-interval", time.Hour, "Interval between purges of deleted accounts")
+
+    // Protection against password guessing, counted per account
+    flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 5, "Failed logins in a row that lock an account")
+    flag.DurationVar(&cfg.login.backoff, "login-backoff", time.Second, "Wait after a failed login, doubled after each further failure")
+    flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long a locked account stays locked")
+
+    // The secret used to sign the pagination cursors
+    flag.StringVar(&cfg.cursor.secret, "cursor-secret", os.Getenv("FITNESS_CURSOR_SECRET"), "Secret used to sign pagination cursors")
+
 	flag.Parse()
     // Initialize a new logger which writes messages to the standard out stream, 
     // prefixed with the current date and time.
@@ -108,30 +188,84 @@ func main() {
     }
     defer db.Close()
 	logger.PrintInfo("datatbase connection pool established", nil)
+
+    // Without a configured secret, cursors are signed with a random one and
+    // stop working when the server restarts
+    if cfg.cursor.secret == "" {
+        secret := make([]byte, 32)
+        _, err = rand.Read(secret)
+        if err != nil {
+            logger.PrintFatal(err, nil)
+        }
+        cfg.cursor.secret = hex.EncodeToString(secret)
+        logger.PrintInfo("no cursor secret configured, using a random one", nil)
+    }
+    // Revoked JWTs only need remembering while they could still be in use
+    var jwtTTL time.Duration
+    if cfg.jwt.enabled {
+        jwtTTL = cfg.tokens.accessTTL
+    }
     // Declare an instance of the application struct, containing the config struct and 
     // the logger.
     app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: data.NewModels(db, cfg.permissions.cacheTTL, jwtTTL),
         mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+        shutdown: make(chan struct{}),
 	}
 
-    // Declare a HTTP server with some sensible timeout settings, which listens on the
-    // port provided in the config struct and uses the servemux we created above as the 
-    // handler.
-    srv := &http.Server{
-        Addr:         fmt.Sprintf(":%d", cfg.port),
-        Handler:      app.routes(),
-        IdleTimeout:  time.Minute,
-        ReadTimeout:  10 * time.Second,
-        WriteTimeout: 30 * time.Second,
-    }
-
-    // Start the HTTP server.
-    logger.PrintInfo("starting server on port 4000", nil)
-    err = srv.ListenAndServe()
-    logger.PrintFatal(err, nil)
+    // Work out client addresses from the forwarding headers of trusted proxies
+    app.proxies, err = realip.New(cfg.proxies.trusted, cfg.proxies.header)
+    if err != nil {
+        logger.PrintFatal(err, nil)
+    }
+
+    // Share the rate limits between instances through the database if asked to
+    switch cfg.limiter.store {
+    case "memory":
+        app.limiter = ratelimit.NewMemoryStore()
+    case "postgres":
+        app.limiter = ratelimit.PostgresStore{DB: db}
+    default:
+        logger.PrintFatal(fmt.Errorf("unknown rate limiter store %q", cfg.limiter.store), nil)
+    }
+
+    // Load the keys that sign and verify the JWTs
+    if cfg.jwt.enabled {
+        app.jwtKeys, err = jwt.LoadKeys(cfg.jwt.keysDir, cfg.jwt.signingKID)
+        if err != nil {
+            logger.PrintFatal(err, nil)
+        }
+        logger.PrintInfo("jwt authentication enabled", map[string]string{
+            "signing_kid": cfg.jwt.signingKID,
+        })
+    }
+
+    // Report the hit rate of the permissions cache on /debug/vars
+    expvar.Publish("permissions_cache", expvar.Func(func() interface{} {
+        return app.models.Permissions.Cache.Stats()
+    }))
+
+    // The scheduled jobs need an interval to tick at
+    if cfg.rollup.interval <= 0 {
+        logger.PrintFatal(fmt.Errorf("rollup-interval must be positive, got %s", cfg.rollup.interval), nil)
+    }
+    if cfg.accounts.purgeInterval <= 0 {
+        logger.PrintFatal(fmt.Errorf("account-purge-interval must be positive, got %s", cfg.accounts.purgeInterval), nil)
+    }
+
+    // Consolidate the intraday increments of past days on a schedule
+    app.scheduleRollUp(cfg.rollup.interval)
+
+    // Purge the deleted accounts whose grace period is over
+    app.schedulePurge(cfg.accounts.purgeInterval)
+
+    // Start the HTTP server, which shuts down gracefully on SIGINT or SIGTERM
+    err = app.serve()
+    if err != nil {
+        logger.PrintFatal(err, nil)
+    }
 }
 
 // Open DB function to return a *sql.DB connection pool
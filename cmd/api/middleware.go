@@ -3,19 +3,32 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"golang.org/x/time/rate"
 	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/jwt"
+	"fitness.zioncastillo.net/internal/ratelimit"
 	"fitness.zioncastillo.net/internal/validator"
 )
 
+// The realIP() middleware works out the address of the client, looking past
+// the trusted proxies in config.proxies, and adds it to the request context
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.proxies != nil {
+			r = app.contextSetClientIP(r, app.proxies.ClientIP(r))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -28,64 +41,109 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Create a client type
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-	// Launch a backaground Goroutine that removes old entries
-	// from the clients map once every minute
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			// Lock before starting to cleanup
-			mu.Lock()
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-			mu.Unlock()
+// The rateLimitByIP() middleware counts every request against the bucket of
+// its client IP address. It runs before authenticate, so requests with bad
+// credentials are throttled too
+func (app *application) rateLimitByIP(next http.Handler, overrides map[string]ratelimit.Policy) http.Handler {
+	return app.rateLimit(next, overrides, func(r *http.Request) string {
+		return "ip:" + app.contextGetClientIP(r)
+	})
+}
+
+// The rateLimitByUser() middleware also counts authenticated requests against
+// the bucket of their user, so that a user cannot get around the limits by
+// spreading requests over several addresses. It runs after authenticate
+func (app *application) rateLimitByUser(next http.Handler, overrides map[string]ratelimit.Policy) http.Handler {
+	return app.rateLimit(next, overrides, func(r *http.Request) string {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			return ""
 		}
-	}()
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	})
+}
+
+// The rateLimit() method counts requests against token buckets in the limiter
+// store, keyed by the identity that identify returns for the request; an
+// empty identity is not counted. A route listed in overrides, keyed by method
+// and path such as "POST /v1/tokens/authentication", has its own bucket and
+// policy; every other route shares the default policy from config.limiter.
+// If the store fails the default routes are let through, but the routes with
+// overrides guard logins and are refused
+func (app *application) rateLimit(next http.Handler, overrides map[string]ratelimit.Policy, identify func(*http.Request) string) http.Handler {
+	defaultPolicy := ratelimit.Policy{Rate: app.config.limiter.rps, Burst: app.config.limiter.burst}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if app.config.limiter.enabled {
-			// Get the IP address of the request
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
+			route := "default"
+			policy := defaultPolicy
+			override, strict := overrides[r.Method+" "+r.URL.Path]
+			if strict {
+				route = r.Method + " " + r.URL.Path
+				policy = override
+			}
+			identity := identify(r)
+			if identity == "" {
+				next.ServeHTTP(w, r)
 				return
 			}
-			// Lock()
-			mu.Lock()
-			// Check if the IP address is in the map
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(
-					rate.Limit(app.config.limiter.rps),
-					app.config.limiter.burst,
-				)}
+			result, err := app.limiter.Allow(r.Context(), route+"|"+identity, policy, time.Now())
+			if err != nil {
+				if strict {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+				// A broken store should not take the whole API down with it
+				app.logError(r, err)
+				next.ServeHTTP(w, r)
+				return
 			}
-			// Update the last seen time of the client
-			clients[ip].lastSeen = time.Now()
-			// Check if request allowed
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-
-			mu.Unlock()
 		} // end of enabled conditional
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The sweepRateLimits() method removes idle buckets from the limiter store
+// once every minute until the server shuts down. A bucket left alone long
+// enough to fill up again can be dropped
+func (app *application) sweepRateLimits(overrides map[string]ratelimit.Policy) {
+	if !app.config.limiter.enabled {
+		return
+	}
+	defaultPolicy := ratelimit.Policy{Rate: app.config.limiter.rps, Burst: app.config.limiter.burst}
+	idle := 3 * time.Minute
+	for _, policy := range append([]ratelimit.Policy{defaultPolicy}, mapValues(overrides)...) {
+		if policy.Rate > 0 {
+			if full := time.Duration(float64(policy.Burst) / policy.Rate * float64(time.Second)); full > idle {
+				idle = full
+			}
+		}
+	}
+	app.schedule(time.Minute, func() {
+		err := app.limiter.Sweep(context.Background(), time.Now().Add(-idle))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// The mapValues() function returns the policies of a map of overrides
+func mapValues(m map[string]ratelimit.Policy) []ratelimit.Policy {
+	values := make([]ratelimit.Policy, 0, len(m))
+	for _, value := range m {
+		values = append(values, value)
+	}
+	return values
+}
+
 // Authentication
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -108,6 +166,34 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Extract the token
 		token := headerParts[1]
+		// A JWT carries everything we need, so there is no database lookup.
+		// Revocations it cannot know about are kept in an in-process denylist
+		if app.jwtKeys != nil && jwt.IsJWT(token) {
+			claims, err := app.jwtKeys.Verify(token, time.Now())
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			id, err := strconv.ParseInt(claims.Subject, 10, 64)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			if app.models.Tokens.Denylist.Denied(id, claims.Family, time.Unix(claims.IssuedAt, 0)) {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, &data.User{ID: id, Activated: claims.Activated, TimeZone: claims.TimeZone})
+			r = app.contextSetToken(r, token)
+			r = app.contextSetClaims(r, claims)
+			next.ServeHTTP(w, r)
+			return
+		}
+		// API keys are told apart from tokens by their prefix
+		if data.IsAPIKey(token) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
 		// Validate the token
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -115,7 +201,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		// Retrieve details about user
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, lastUsedAt, err := app.models.Users.GetForSessionToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -125,13 +211,58 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+		// Record when the session was last used, unless that was just now
+		if data.NeedsTouch(lastUsedAt, time.Now()) {
+			app.background(func() {
+				err := app.models.Tokens.Touch(token)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
 		// Add the user information to the request context
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		// Call the next handler in the chain
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateAPIKey() method looks up the owner of an API key and adds
+// both to the request context. The key is not stored as the bearer token, so
+// it can never be mistaken for a session
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	// Validate the key
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	// Retrieve the key and the user who owns it
+	key, user, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Record when the key was last used, unless that was just now
+	if data.NeedsTouch(key.LastUsedAt, time.Now()) {
+		app.background(func() {
+			err := app.models.APIKeys.Touch(key.ID)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
 // Check for authenticated user
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -166,8 +297,8 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Get the user
 		user := app.contextGetUser(r)
-		// Get the permission slice for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the effective permissions of the user, including those of their roles
+		permissions, err := app.userPermissions(r, user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -183,6 +314,36 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// Check that the user signed in with a password rather than an API key. Keys
+// are meant for scripts and devices, so they cannot manage keys or sessions
+func (app *application) requireSessionUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+// The userPermissions() method returns the permissions of the authenticated
+// user. A JWT already carries them, otherwise they are read from the database.
+// An API key only grants the scopes that its owner still holds
+func (app *application) userPermissions(r *http.Request, user *data.User) (data.Permissions, error) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		return data.Permissions(claims.Permissions), nil
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if key := app.contextGetAPIKey(r); key != nil {
+		return permissions.Intersect(key.Scopes), nil
+	}
+	return permissions, nil
+}
+
 // Enable CORS
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,247 @@
+// Filename: cmd/api/permissions.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// listPermissionsHandler lists every permission code that can be granted
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	codes, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPermissionUsersHandler lists the users holding the permission code in the URL
+func (app *application) listPermissionUsersHandler(w http.ResponseWriter, r *http.Request) {
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+	codes, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !codes.Include(code) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	users, err := app.models.Permissions.GetUsersForCode(code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserPermissionsHandler lists the permissions of the user in the URL
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	app.writeUserPermissions(w, r, user)
+}
+
+// grantUserPermissionsHandler grants permission codes to the user in the URL
+// directly, on top of their roles. Codes the user already holds are left as they are
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, app.models.Permissions.AddForUser)
+}
+
+// revokeUserPermissionsHandler revokes permission codes granted directly to the
+// user in the URL. Codes that come from a role are only lost with the role
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, app.models.Permissions.RemoveForUser)
+}
+
+// The changeUserPermissions() method reads and validates a list of codes, applies
+// change to the user in the URL and responds with the user's new permissions
+func (app *application) changeUserPermissions(w http.ResponseWriter, r *http.Request, change func(int64, ...string) error) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Codes []string `json:"codes"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidatePermissionCodes(v, input.Codes, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = change(user.ID, input.Codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user)
+}
+
+// The readUserParam() method loads the user whose id is in the URL. It writes
+// the error response itself and reports whether the handler should go on
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// The writeUserPermissions() method responds with a user, their roles, the codes
+// granted to them directly and the effective permissions that result
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	granted, err := app.models.Permissions.GetGrantedForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{
+		"user":        user,
+		"roles":       roles,
+		"granted":     granted,
+		"permissions": permissions,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listRolesHandler lists every role along with its permission codes
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// assignUserRolesHandler assigns roles to the user in the URL
+func (app *application) assignUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserRoles(w, r, app.models.Roles.AddForUser)
+}
+
+// removeUserRolesHandler takes roles away from the user in the URL
+func (app *application) removeUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserRoles(w, r, app.models.Roles.RemoveForUser)
+}
+
+// The changeUserRoles() method reads and validates a list of role names, applies
+// change to the user in the URL and responds with the user's new permissions
+func (app *application) changeUserRoles(w http.ResponseWriter, r *http.Request, change func(int64, ...string) error) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	known, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateRoleNames(v, input.Roles, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = change(user.ID, input.Roles...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user)
+}
+
+// unlockUserHandler lifts the lockout of the user in the URL and forgets their
+// failed logins
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	err := app.models.LoginFailures.Reset(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resetUserTOTPHandler turns two-factor authentication off for the user in the
+// URL, for someone who lost both their app and their recovery codes
+func (app *application) resetUserTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	err := app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled for the user"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
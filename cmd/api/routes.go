@@ -3,7 +3,9 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
+	"fitness.zioncastillo.net/internal/ratelimit"
 	"github.com/julienschmidt/httprouter"
 )
 func (app *application) routes () http.Handler{
@@ -14,11 +16,74 @@ func (app *application) routes () http.Handler{
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/records/insert", app.requirePermission("dailyfitness:read", app.saveFitnessHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/records/show", app.requirePermission("dailyfitness:read", app.listFitnessHandler))
+	// The metrics include the command line, so only admins may read them
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("permissions:admin", expvar.Handler().ServeHTTP))
+	router.HandlerFunc(http.MethodPost, "/v1/records/insert", app.requirePermission("dailyfitness:write", app.saveFitnessHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/records/steps", app.requirePermission("dailyfitness:write", app.addStepsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/records/cups", app.requirePermission("dailyfitness:write", app.addCupsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/records/:id", app.requirePermission("dailyfitness:read", app.recordsGetHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/records/:id", app.requirePermission("dailyfitness:write", app.updateFitnessHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/records/:id", app.requirePermission("dailyfitness:write", app.deleteFitnessHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/goals", app.requirePermission("dailyfitness:write", app.setGoalHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/goals", app.requirePermission("dailyfitness:read", app.listGoalsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/goals/progress", app.requirePermission("dailyfitness:read", app.goalProgressHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/streaks", app.requirePermission("dailyfitness:read", app.streaksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/records", app.requirePermission("dailyfitness:admin", app.adminSaveFitnessHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/records", app.requirePermission("dailyfitness:admin", app.adminListFitnessHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("permissions:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions/:code/users", app.requirePermission("permissions:admin", app.listPermissionUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("permissions:admin", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/totp", app.requirePermission("permissions:admin", app.resetUserTOTPHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("permissions:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("permissions:admin", app.assignUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles", app.requirePermission("permissions:admin", app.removeUserRolesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireSessionUser(app.requireActivatedUser(app.updateCurrentUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireSessionUser(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireSessionUser(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/restored", app.restoreUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireSessionUser(app.requireActivatedUser(app.startTOTPEnrollmentHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp", app.requireSessionUser(app.requireActivatedUser(app.confirmTOTPEnrollmentHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireSessionUser(app.disableTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/recovery-codes", app.requireSessionUser(app.regenerateRecoveryCodesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireSessionUser(app.requireActivatedUser(app.requestEmailChangeHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/totp", app.createTOTPAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireSessionUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/sessions", app.requireSessionUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/sessions", app.requireSessionUser(app.deleteSessionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireSessionUser(app.requireActivatedUser(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireSessionUser(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireSessionUser(app.deleteAPIKeyHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+	// Routes that check passwords, codes or emailed tokens get a much
+	// stricter limit than the rest of the API
+	authPolicy := ratelimit.Policy{Rate: app.config.limiter.authRPS, Burst: app.config.limiter.authBurst}
+	limits := map[string]ratelimit.Policy{
+		"POST /v1/tokens/authentication": authPolicy,
+		"POST /v1/tokens/totp":           authPolicy,
+		"POST /v1/tokens/password-reset": authPolicy,
+		"POST /v1/tokens/activation":     authPolicy,
+		"POST /v1/users":                 authPolicy,
+		"PUT /v1/users/activated":        authPolicy,
+		"PUT /v1/users/password":         authPolicy,
+		"PUT /v1/users/email":            authPolicy,
+		"PUT /v1/users/restored":         authPolicy,
+	}
+
+	app.sweepRateLimits(limits)
+
+	// Limit by address before authenticating, so that guessing tokens is
+	// throttled too, and by user after it
+	return app.realIP(app.recoverPanic(app.enableCORS(app.rateLimitByIP(app.authenticate(app.rateLimitByUser(router, limits)), limits))))
 }
\ No newline at end of file
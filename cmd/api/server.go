@@ -51,6 +51,8 @@ func (app *application) serve() error {
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
+		// Stop the scheduled jobs before waiting on them
+		close(app.shutdown)
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
@@ -4,9 +4,11 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/jwt"
 	"fitness.zioncastillo.net/internal/validator"
 )
 
@@ -33,34 +35,381 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
+		// An unknown address is counted and held back like a wrong password,
+		// so the response does not tell that there is no account
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r) // implement this later
+			app.verifyLoginSecret(w, r, input.Email, nil, func() (bool, error) {
+				return data.NoAccountPasswordMatches(input.Password)
+			})
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// Check if the password matches
-	match, err := user.Password.Matches(input.Password)
+	// Check if the password matches, unless the account has to wait
+	if !app.verifyLoginPassword(w, r, user, input.Password) {
+		return
+	}
+	// With two-factor authentication on, the password only earns a challenge
+	// token that has to be exchanged along with a code
+	enabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if enabled {
+		challenge, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTOTPChallenge)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"challenge_token": challenge}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// A successful login starts the count of failed ones over
+	err = app.models.LoginFailures.Reset(user.Email)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// If passwords don't match, then return an invalid credentials response
+	// Password is correct, so we will generate a authentication token along
+	// with a refresh token that can be exchanged for new ones later
+	token, refreshToken, err := app.issueTokens(r, user, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Return the authentication token to the client
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+// The verifyLoginPassword() method checks the password of a user who is logging
+// in, or who confirms a sensitive change with it. The method writes the error
+// response itself and reports whether the password matched
+func (app *application) verifyLoginPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	return app.verifyLoginSecret(w, r, user.Email, user, func() (bool, error) {
+		return user.Password.Matches(password)
+	})
+}
+
+// The verifyLoginSecret() method runs check, which tests a password or code
+// sent by a user who is logging in. Failed attempts are counted per email
+// address: each one doubles the wait before the next attempt is allowed, and
+// too many in a row lock the address and tell the account's owner by email.
+// The user is nil when no account has the address, which is counted and
+// answered all the same. A passed check does not start the count over, since
+// the password alone is not a full login when a second factor follows; the
+// login handlers reset it once the user is in. The method writes the error
+// response itself and reports whether the check passed
+func (app *application) verifyLoginSecret(w http.ResponseWriter, r *http.Request, email string, user *data.User, check func() (bool, error)) bool {
+	policy := app.loginPolicy()
+	failure, err := app.models.LoginFailures.Get(email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	// The secret is not even checked while the account has to wait
+	if wait := failure.RetryAfter(time.Now(), policy); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return false
+	}
+	match, err := check()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
 	if !match {
+		failure, locked, err := app.models.LoginFailures.RecordFailure(email, policy)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		if locked && user != nil {
+			app.background(func() {
+				mailData := map[string]interface{}{
+					"lockedUntil": failure.LockedUntil.UTC().Format(time.RFC1123),
+				}
+				err := app.mailer.Send(user.Email, "account_locked.tmpl", mailData)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
 		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// The loginPolicy() method returns the configured limits on failed logins
+func (app *application) loginPolicy() data.LoginPolicy {
+	return data.LoginPolicy{
+		MaxFailures: app.config.login.maxFailures,
+		Backoff:     app.config.login.backoff,
+		Lockout:     app.config.login.lockout,
+	}
+}
+
+// createPasswordResetTokenHandler emails a password reset token to the user
+// with the given email address. The response is the same whether or not the
+// address belongs to an account, so it cannot be used to discover users
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the email from the request body
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Validate the email
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Password is correct, so we will generate a authentication token
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Get the user details based on the provided email
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Only activated accounts can reset their password
+	if err == nil && user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.background(func() {
+			mailData := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			}
+			// Send the email to the user
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", mailData)
+			if err != nil {
+				// log errors
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+	// Write a 202 Accepted Status
+	env := envelope{"message": "if the email address belongs to an activated account, an email will be sent to it containing password reset instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createActivationTokenHandler replaces the activation token of an account
+// that has not been activated yet and emails the new one. The response is the
+// same whether or not the address belongs to such an account
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the email from the request body
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	// Return the authentication token to the client
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	// Validate the email
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Get the user details based on the provided email
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err == nil && !user.Activated {
+		// Old activation tokens stop working once a new one is issued
+		err = app.models.Tokens.DeleteAllForUsers(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.background(func() {
+			mailData := map[string]interface{}{
+				"activationToken": token.Plaintext,
+			}
+			// Send the email to the user
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", mailData)
+			if err != nil {
+				// log errors
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+	// Write a 202 Accepted Status
+	env := envelope{"message": "if the email address belongs to an account that is not activated yet, an email will be sent to it containing activation instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler logs out by revoking the bearer token that
+// was sent with the request
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	// A JWT is denied from now on along with the refresh tokens of its family
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.models.Tokens.DeleteFamily(claims.Family)
+	} else {
+		err = app.models.Tokens.Revoke(data.ScopeAuthentication, app.contextGetToken(r))
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler lists the sessions the authenticated user is logged in with
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	// With JWTs only the refresh tokens are stored, one per live session
+	scope, family := data.ScopeAuthentication, ""
+	if claims := app.contextGetClaims(r); claims != nil {
+		scope, family = data.ScopeRefresh, claims.Family
+	}
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, scope, app.contextGetToken(r), family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSessionsHandler logs the authenticated user out everywhere by revoking
+// all of their authentication and refresh tokens, including the current one
+func (app *application) deleteSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUsers(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a short-lived
+// authentication token and a new refresh token. Each refresh token can only
+// be used once; replaying one revokes every token issued since the login
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the refresh token from the request body
+	var input struct {
+		TokenPlaintext string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Use up the refresh token
+	userID, family, err := app.models.Tokens.ConsumeRefresh(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Issue the next pair of tokens in the same family
+	token, refreshToken, err := app.issueTokens(r, user, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
 
-}
\ No newline at end of file
+// issueTokens creates the authentication and refresh tokens handed out on login
+// and on refresh. The authentication token lives for the access TTL whether it
+// is an opaque token or, in JWT mode, a signed JWT
+func (app *application) issueTokens(r *http.Request, user *data.User, family string) (*data.Token, *data.Token, error) {
+	if app.jwtKeys == nil {
+		return app.models.Tokens.NewPair(user.ID, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), family)
+	}
+	refreshToken, err := app.models.Tokens.NewRefresh(user.ID, app.config.tokens.refreshTTL, r.UserAgent(), family)
+	if err != nil {
+		return nil, nil, err
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	now := time.Now()
+	token := &data.Token{
+		UserID: user.ID,
+		Expiry: now.Add(app.config.tokens.accessTTL),
+		Scope:  data.ScopeAuthentication,
+		Family: refreshToken.Family,
+	}
+	token.Plaintext, err = app.jwtKeys.Sign(jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		Activated:   user.Activated,
+		TimeZone:    user.TimeZone,
+		Permissions: permissions,
+		Family:      refreshToken.Family,
+		IssuedAt:    now.Unix(),
+		Expiry:      token.Expiry.Unix(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, refreshToken, nil
+}
@@ -0,0 +1,327 @@
+// Filename: cmd/api/totp.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"fitness.zioncastillo.net/internal/data"
+	"fitness.zioncastillo.net/internal/totp"
+	"fitness.zioncastillo.net/internal/validator"
+)
+
+// The issuer shown next to the account in authenticator apps
+const totpIssuer = "BIO"
+
+// startTOTPEnrollmentHandler generates a new two-factor secret for the
+// authenticated user. It takes the password, so that a stolen token cannot
+// enroll a secret of the thief's own, and does nothing until confirmed with a
+// first code
+func (app *application) startTOTPEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Guesses here count towards the same lockout as logins
+	if !app.verifyLoginPassword(w, r, user, input.Password) {
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.TOTP.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	env := envelope{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTOTPEnrollmentHandler turns two-factor authentication on once the
+// user sends a code from their app, and hands out the recovery codes
+func (app *application) confirmTOTPEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	t, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if t.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Allow one step of clock drift either way
+	counter, ok := totp.Validate(t.Secret, input.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid or expired code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	codes, err := app.models.TOTP.Confirm(user.ID, counter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "invalid or expired code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTOTPHandler turns two-factor authentication off. It takes the
+// password and a code, or a recovery code if the app was lost
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Guesses here count towards the same lockout as logins
+	if !app.verifyLoginPassword(w, r, user, input.Password) {
+		return
+	}
+	if !app.verifySecondFactor(w, r, user, input.Code, input.RecoveryCode) {
+		return
+	}
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// regenerateRecoveryCodesHandler replaces the user's recovery codes after
+// checking a code from their app
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Load the full user, since a lockout email needs their address
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.verifySecondFactor(w, r, user, input.Code, "") {
+		return
+	}
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTOTPAuthenticationTokenHandler finishes a two-step login. It exchanges
+// the challenge token from createAuthenticationTokenHandler and a code, or a
+// recovery code, for an authentication token
+func (app *application) createTOTPAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.ChallengeToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.GetForToken(data.ScopeTOTPChallenge, input.ChallengeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("challenge_token", "invalid or expired challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.verifySecondFactor(w, r, user, input.Code, input.RecoveryCode) {
+		return
+	}
+	// Both factors passed, so the count of failed logins starts over
+	err = app.models.LoginFailures.Reset(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The challenge is answered, so it cannot be used again
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopeTOTPChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, refreshToken, err := app.issueTokens(r, user, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The verifySecondFactor() method checks either a code or a recovery code for
+// a user with two-factor authentication enabled. Wrong guesses count towards
+// the login lockout. The method writes the error response itself and reports
+// whether the check passed
+func (app *application) verifySecondFactor(w http.ResponseWriter, r *http.Request, user *data.User, code string, recoveryCode string) bool {
+	v := validator.New()
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	v.Check(code == "" || recoveryCode == "", "recovery_code", "must not be given along with a code")
+	if code != "" {
+		data.ValidateTOTPCode(v, code)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	t, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if t == nil || !t.Confirmed {
+		v.AddError("totp", "two-factor authentication is not enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return app.verifyLoginSecret(w, r, user.Email, user, func() (bool, error) {
+		if recoveryCode != "" {
+			err := app.models.TOTP.UseRecoveryCode(user.ID, recoveryCode)
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+		return app.checkTOTPCode(t, code)
+	})
+}
+
+// The checkTOTPCode() method reports whether code is valid for t right now
+// and has not been used before. An accepted code is recorded as used
+func (app *application) checkTOTPCode(t *data.TOTP, code string) (bool, error) {
+	// Allow one step of clock drift either way
+	counter, ok := totp.Validate(t.Secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+	err := app.models.TOTP.UseCounter(t.UserID, counter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"fitness.zioncastillo.net/internal/data"
@@ -52,8 +54,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	// Add permissions for the newly inserted user
-	err = app.models.Permissions.AddForUser(user.ID, "schools:read")
+	// Assign the default roles to the newly inserted user
+	err = app.models.Roles.AddForUser(user.ID, data.DefaultRoles...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -66,12 +68,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	app.background(func() {
-		data := map[string]interface{}{
+		mailData := map[string]interface{}{
 			"activationToken": token.Plaintext,
 			"userID":          user.ID,
 		}
 		// Send the email to the new user
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err = app.mailer.Send(user.Email, "user_welcome.tmpl", mailData)
 		if err != nil {
 			// log errors
 			app.logger.PrintError(err, nil)
@@ -138,3 +140,472 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the new password and the password reset token
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Get the user details of the provided token
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Hash and store the new password
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Proving control of the email address lifts any lockout
+	err = app.models.LoginFailures.Reset(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The reset token is used up, and anyone holding an old authentication
+	// token has to log in again with the new password
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err = app.models.Tokens.DeleteAllForUsers(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	// Send the user a confirmation message
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentUserHandler returns the profile of the authenticated user
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Load the full user, since one built from a JWT only has its ID set
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler changes the name and profile fields of the
+// authenticated user. A client may send the version it last saw, and the
+// update is refused with a 409 if the user has changed since
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Pointers tell fields that were left out apart from zero values
+	var input struct {
+		Name      *string  `json:"name"`
+		HeightCM  *float64 `json:"height_cm"`
+		WeightKG  *float64 `json:"weight_kg"`
+		BirthDate *string  `json:"birth_date"`
+		TimeZone  *string  `json:"time_zone"`
+		Units     *string  `json:"units"`
+		Version   *int     `json:"version"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Version != nil && *input.Version != user.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.HeightCM != nil {
+		user.HeightCM = input.HeightCM
+	}
+	if input.WeightKG != nil {
+		user.WeightKG = input.WeightKG
+	}
+	if input.BirthDate != nil {
+		user.BirthDate = input.BirthDate
+	}
+	if input.TimeZone != nil {
+		user.TimeZone = *input.TimeZone
+	}
+	if input.Units != nil {
+		user.Units = *input.Units
+	}
+	// Perform validation
+	v := validator.New()
+	data.ValidateUser(v, user)
+	if data.ValidateProfile(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler starts moving the authenticated user to a new email
+// address. A confirmation token goes to the new address and a notice to the
+// old one. The password is asked for again since this hands over the account
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Guesses here count towards the same lockout as logins
+	if !app.verifyLoginPassword(w, r, user, input.Password) {
+		return
+	}
+	// Email addresses are case-insensitive
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from the current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	_, err = app.models.Users.GetByEmail(input.Email)
+	if err == nil {
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	} else if !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Only the latest request can be confirmed
+	err = app.models.Tokens.DeleteAllForUsers(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.NewEmailChange(user.ID, time.Hour, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.background(func() {
+		err := app.mailer.Send(input.Email, "token_email_change.tmpl", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		err = app.mailer.Send(user.Email, "email_change_notice.tmpl", map[string]interface{}{
+			"newEmail": input.Email,
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	// Write a 202 Accepted Status
+	env := envelope{"message": "an email will be sent to the new address containing instructions to confirm it"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler moves a user to the address their email-change
+// token was issued for and logs them out everywhere
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Perform validation
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, email, err := app.models.Users.GetForEmailChangeToken(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user.Email = email
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		// Someone else took the address after the change was requested
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// The change token is used up, password reset tokens went to the old
+	// address, and every session has to log in again
+	scopes := []string{
+		data.ScopeEmailChange,
+		data.ScopePasswordReset,
+		data.ScopeAuthentication,
+		data.ScopeRefresh,
+	}
+	for _, scope := range scopes {
+		err = app.models.Tokens.DeleteAllForUsers(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler deletes the authenticated user after they confirm
+// their password. The account is kept for the deletion grace period, during
+// which it can be restored, and is then purged along with all its data
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Guesses here count towards the same lockout as logins
+	if !app.verifyLoginPassword(w, r, user, input.Password) {
+		return
+	}
+	err = app.models.Users.SoftDelete(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Every outstanding token stops working with the account
+	scopes := []string{
+		data.ScopeActivation,
+		data.ScopeAuthentication,
+		data.ScopeRefresh,
+		data.ScopePasswordReset,
+		data.ScopeEmailChange,
+	}
+	for _, scope := range scopes {
+		err = app.models.Tokens.DeleteAllForUsers(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	env := envelope{
+		"message":  "your account has been deleted and can be restored until it is purged",
+		"purge_at": time.Now().Add(app.config.accounts.deletionGrace).UTC(),
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreUserHandler brings back a deleted account that has not been purged
+// yet. The user has to log in again afterwards
+func (app *application) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	since := time.Now().Add(-app.config.accounts.deletionGrace)
+	user, err := app.models.Users.GetDeletedByEmail(input.Email, since)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Guesses here count towards the same lockout as logins
+	if !app.verifyLoginPassword(w, r, user, input.Password) {
+		return
+	}
+	err = app.models.Users.Restore(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// schedulePurge starts a Goroutine that purges the accounts whose deletion
+// grace period is over, along with failed logins that no longer count, once
+// every interval until the server shuts down
+func (app *application) schedulePurge(interval time.Duration) {
+	app.schedule(interval, func() {
+		app.purgeDeletedUsers()
+		app.purgeLoginFailures()
+	})
+}
+
+// purgeDeletedUsers permanently removes the accounts deleted before the grace period
+func (app *application) purgeDeletedUsers() {
+	purged, err := app.models.Users.Purge(time.Now().Add(-app.config.accounts.deletionGrace))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if purged > 0 {
+		app.logger.PrintInfo("purged deleted users", map[string]string{
+			"users": strconv.Itoa(purged),
+		})
+	}
+}
+
+// purgeLoginFailures forgets the failed logins that can no longer make anyone
+// wait, most of which are for email addresses that have no account
+func (app *application) purgeLoginFailures() {
+	purged, err := app.models.LoginFailures.DeleteExpired(app.loginPolicy())
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if purged > 0 {
+		app.logger.PrintInfo("purged login failures", map[string]string{
+			"login_failures": strconv.Itoa(purged),
+		})
+	}
+}
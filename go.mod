@@ -3,10 +3,13 @@ module fitness.zioncastillo.net
 go 1.19
 
 require (
-	github.com/julienschmidt/httprouter v1.3.0 // indirect
-	github.com/lib/pq v1.10.7 // indirect
-	golang.org/x/crypto v0.2.0 // indirect
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.7
+	golang.org/x/crypto v0.2.0
+	gopkg.in/mail.v2 v2.3.1
+)
+
+require (
 	golang.org/x/time v0.3.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
-	gopkg.in/mail.v2 v2.3.1 // indirect
 )
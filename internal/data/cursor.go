@@ -0,0 +1,70 @@
+// Filename: internal/data/cursor.go
+
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// A cursor marks a position in a keyset-paginated listing. It holds the value
+// of the sort column and the id of the row it points at, so the next query can
+// continue from there without an OFFSET
+type cursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	ID       int    `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// The encodeCursor() function serializes the cursor and appends an HMAC-SHA256
+// signature so that clients cannot forge or tamper with it
+func encodeCursor(key []byte, c cursor) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	signature := mac.Sum(nil)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// The decodeCursor() function checks the signature and returns the cursor
+func decodeCursor(key []byte, token string) (cursor, error) {
+	var c cursor
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return c, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	// Compare the signatures in constant time
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return c, ErrInvalidCursor
+	}
+
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
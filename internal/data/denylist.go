@@ -0,0 +1,95 @@
+// Filename: internal/data/denylist.go
+
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// A TokenDenylist remembers revocations that stateless JWTs cannot see for
+// themselves, so the authenticate middleware can turn them away without a
+// database round trip. An entry only has to outlive the JWTs issued before
+// it, so each one is forgotten after the access token TTL. The list lives in
+// the process, so every instance only sees its own revocations. A nil list is
+// valid and denies nothing
+type TokenDenylist struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	families  map[string]time.Time
+	users     map[int64]time.Time
+	lastSweep time.Time
+}
+
+// NewTokenDenylist() returns a denylist for JWTs that live for ttl, or nil
+// when ttl is not positive
+func NewTokenDenylist(ttl time.Duration) *TokenDenylist {
+	if ttl <= 0 {
+		return nil
+	}
+	return &TokenDenylist{
+		ttl:       ttl,
+		families:  make(map[string]time.Time),
+		users:     make(map[int64]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// RevokeFamily() denies every JWT issued in a token family
+func (d *TokenDenylist) RevokeFamily(family string) {
+	if d == nil || family == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.sweep(now)
+	d.families[family] = now
+}
+
+// RevokeUser() denies every JWT a user was issued up to now, for changes such
+// as a new password or new permissions. JWTs carry their issue time in whole
+// seconds, so one issued later within the same second is denied as well
+func (d *TokenDenylist) RevokeUser(userID int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.sweep(now)
+	d.users[userID] = now
+}
+
+// Denied() reports whether a JWT issued to a user in a family at issuedAt has
+// been revoked
+func (d *TokenDenylist) Denied(userID int64, family string, issuedAt time.Time) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.families[family]; ok {
+		return true
+	}
+	revokedAt, ok := d.users[userID]
+	return ok && !issuedAt.After(revokedAt.Truncate(time.Second))
+}
+
+// The sweep() method forgets revocations older than every JWT they could deny
+func (d *TokenDenylist) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) <= d.ttl {
+		return
+	}
+	for family, revokedAt := range d.families {
+		if now.Sub(revokedAt) > d.ttl {
+			delete(d.families, family)
+		}
+	}
+	for id, revokedAt := range d.users {
+		if now.Sub(revokedAt) > d.ttl {
+			delete(d.users, id)
+		}
+	}
+	d.lastSweep = now
+}
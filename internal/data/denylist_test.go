@@ -0,0 +1,119 @@
+// Filename: internal/data/denylist_test.go
+
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenDenylist(t *testing.T) {
+	now := time.Now()
+	before := now.Add(-time.Minute)
+	after := now.Add(time.Minute)
+
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		revoke   func(d *TokenDenylist)
+		userID   int64
+		family   string
+		issuedAt time.Time
+		want     bool
+	}{
+		{
+			name:     "nothing revoked",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) {},
+			userID:   1,
+			family:   "family",
+			issuedAt: before,
+			want:     false,
+		},
+		{
+			name:     "family revoked",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) { d.RevokeFamily("family") },
+			userID:   1,
+			family:   "family",
+			issuedAt: before,
+			want:     true,
+		},
+		{
+			name:     "another family revoked",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) { d.RevokeFamily("other") },
+			userID:   1,
+			family:   "family",
+			issuedAt: before,
+			want:     false,
+		},
+		{
+			name:     "user revoked after the token was issued",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) { d.RevokeUser(1) },
+			userID:   1,
+			family:   "family",
+			issuedAt: before,
+			want:     true,
+		},
+		{
+			name:     "user revoked in the second the token was issued",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) { d.RevokeUser(1) },
+			userID:   1,
+			family:   "family",
+			issuedAt: time.Unix(time.Now().Unix(), 0),
+			want:     true,
+		},
+		{
+			name:     "token issued after the user was revoked",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) { d.RevokeUser(1) },
+			userID:   1,
+			family:   "family",
+			issuedAt: after,
+			want:     false,
+		},
+		{
+			name:     "another user revoked",
+			ttl:      time.Minute,
+			revoke:   func(d *TokenDenylist) { d.RevokeUser(2) },
+			userID:   1,
+			family:   "family",
+			issuedAt: before,
+			want:     false,
+		},
+		{
+			name:     "ttl of zero turns the denylist off",
+			ttl:      0,
+			revoke:   func(d *TokenDenylist) { d.RevokeFamily("family"); d.RevokeUser(1) },
+			userID:   1,
+			family:   "family",
+			issuedAt: before,
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewTokenDenylist(tt.ttl)
+			tt.revoke(d)
+			if got := d.Denied(tt.userID, tt.family, tt.issuedAt); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenDenylistSweep(t *testing.T) {
+	d := NewTokenDenylist(time.Minute)
+	d.RevokeFamily("family")
+	d.RevokeUser(1)
+	// Once every JWT issued before them has expired the entries are dropped
+	later := time.Now().Add(2 * time.Minute)
+	d.sweep(later)
+	if len(d.families) != 0 || len(d.users) != 0 {
+		t.Errorf("got %d families and %d users after the sweep; want none", len(d.families), len(d.users))
+	}
+}
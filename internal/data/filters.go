@@ -14,12 +14,25 @@ type Filters struct {
 	PageSize int
 	Sort     string
 	SortList []string
+	// In cursor mode the listing is paginated by keyset instead of OFFSET.
+	// Cursor is empty for the first page and CursorKey signs the cursors
+	CursorMode bool
+	Cursor     string
+	CursorKey  []byte
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check page and page_size parameters
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 1000, "page", "must be a maximum of 1000")
+	if f.CursorMode {
+		// Check that the cursor was issued by us for the same sort order
+		if f.Cursor != "" {
+			c, err := decodeCursor(f.CursorKey, f.Cursor)
+			v.Check(err == nil && c.Sort == f.Sort, "cursor", "invalid cursor")
+		}
+	} else {
+		v.Check(f.Page > 0, "page", "must be greater than zero")
+		v.Check(f.Page <= 1000, "page", "must be a maximum of 1000")
+	}
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	// Check that the sort parameter matches a value in the acceptable sort list
@@ -44,6 +57,19 @@ func (f Filters) sortOrder() string {
 	return "ASC"
 }
 
+// The keysetOrder() method returns the direction to scan in for a cursor. A
+// backward cursor walks the sort order in reverse
+func (f Filters) keysetOrder(backward bool) string {
+	order := f.sortOrder()
+	if backward {
+		if order == "ASC" {
+			return "DESC"
+		}
+		return "ASC"
+	}
+	return order
+}
+
 // The limit() method determines the LIMIT
 func (f Filters) limit() int {
 	return f.PageSize
@@ -56,11 +82,13 @@ func (f Filters) offset() int {
 
 // The Metadata type contains metadata to help with pagination
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // The calculateMetadata() function computes the values for the Metadata fields
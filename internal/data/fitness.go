@@ -4,6 +4,8 @@ package data
 
 import (
 	"database/sql"
+	"errors"
+	"strconv"
 	"time"
 	"fmt"
 	"context"
@@ -12,18 +14,102 @@ import (
 
 )
 
+var (
+	ErrUnknownUser     = errors.New("unknown user")
+	ErrDuplicateRecord = errors.New("duplicate record")
+)
+
+// How a new record is stored when the user already has one for that day
+const (
+	UpsertCreate  = "create"  // fail with ErrDuplicateRecord
+	UpsertReplace = "replace" // overwrite the day's steps and cups
+	UpsertAdd     = "add"     // add to the day's steps and cups
+)
+
+var UpsertModes = []string{UpsertCreate, UpsertReplace, UpsertAdd}
+
 type Fitness struct {
 	ID	    int     `json:"id"`
-	User_id  int     `json:"user_id"`
+	User_id  int64   `json:"user_id"`
 	Steps   int     `json:"steps"`
 	Cups    int     `json:"cups"`
 	Date 	time.Time `json:"date"`
+	LocalDate string `json:"local_date"`
+	Version int     `json:"version"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// FitnessQuery holds the filters for a listing of fitness records. A nil
+// pointer or a zero id means that the filter is not applied. From and To are
+// compared against the local date of the records
+type FitnessQuery struct {
+	ID       int
+	UserID   int64
+	Steps    *int
+	StepsMin *int
+	StepsMax *int
+	Cups     *int
+	CupsMin  *int
+	CupsMax  *int
+	From     *time.Time
+	To       *time.Time
+}
+
+func ValidateFitnessQuery(v *validator.Validator, q FitnessQuery) {
+	v.Check(q.ID >= 0, "id", "cannot be less than 0")
+	v.Check(q.UserID >= 0, "user_id", "cannot be less than 0")
+	v.Check(q.Steps == nil || *q.Steps >= 0, "steps", "cannot be less than 0")
+	v.Check(q.StepsMin == nil || *q.StepsMin >= 0, "steps_min", "cannot be less than 0")
+	v.Check(q.StepsMax == nil || *q.StepsMax >= 0, "steps_max", "cannot be less than 0")
+	v.Check(q.Cups == nil || *q.Cups >= 0, "cups", "cannot be less than 0")
+	v.Check(q.CupsMin == nil || *q.CupsMin >= 0, "cups_min", "cannot be less than 0")
+	v.Check(q.CupsMax == nil || *q.CupsMax >= 0, "cups_max", "cannot be less than 0")
+	// Check that the ranges are not back to front
+	if q.StepsMin != nil && q.StepsMax != nil {
+		v.Check(*q.StepsMin <= *q.StepsMax, "steps_max", "must be greater than or equal to steps_min")
+	}
+	if q.CupsMin != nil && q.CupsMax != nil {
+		v.Check(*q.CupsMin <= *q.CupsMax, "cups_max", "must be greater than or equal to cups_min")
+	}
+	if q.From != nil && q.To != nil {
+		v.Check(!q.To.Before(*q.From), "to", "must not be before from")
+	}
+}
+
+// The periods that fitness statistics can be grouped by
+var StatsPeriods = []string{"day", "week", "month"}
+
+// MetricStats summarizes one metric over a bucket of records
+type MetricStats struct {
+	Total   int64   `json:"total"`
+	Average float64 `json:"average"`
+	Min     int     `json:"min"`
+	Max     int     `json:"max"`
+}
+
+// FitnessStats holds the aggregate statistics for one day, ISO week or month.
+// Start is the first local date of the bucket
+type FitnessStats struct {
+	Start   string      `json:"start"`
+	Records int         `json:"records"`
+	Steps   MetricStats `json:"steps"`
+	Cups    MetricStats `json:"cups"`
+}
+
+func ValidateStatsPeriod(v *validator.Validator, period string) {
+	v.Check(validator.In(period, StatsPeriods...), "period", "must be one of day, week or month")
+}
+
+func ValidateUpsertMode(v *validator.Validator, mode string) {
+	v.Check(validator.In(mode, UpsertModes...), "mode", "must be one of create, replace or add")
 }
 
 func ValidateItem(v *validator.Validator, fitness *Fitness) {
 	// Use the Check() method to execute our validation checks
-	//v.Check(fitness.Steps < 0, "Steps", "cannot be less than 0")
-	//v.Check(fitness.Cups < 0, "Cups", "cannot be less than 0")
+	v.Check(fitness.Steps >= 0, "steps", "cannot be less than 0")
+	v.Check(fitness.Cups >= 0, "cups", "cannot be less than 0")
+	_, err := time.Parse("2006-01-02", fitness.LocalDate)
+	v.Check(err == nil, "date", "must be a date in the format YYYY-MM-DD")
 }
 
  //Define a FitnessModel which wraps a sql.DB connection pool
@@ -32,42 +118,281 @@ type FitnessModel struct {
 }
 
 //Insert function that will insert the users fitness tracked for the day
+//A user can only have one record per local date
 func (m FitnessModel) Insert(fitness * Fitness) error {
 	
 	query := `
-		INSERT INTO dailyfitness (user_id, steps, cups)
-		VALUES ($1, $2, $3)
-		RETURNING id, date
+		INSERT INTO dailyfitness (user_id, steps, cups, local_date)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, date, version
 	`
 	args := []interface{}{
 		fitness.User_id,
 		fitness.Steps,
 		fitness.Cups,
+		fitness.LocalDate,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&fitness.ID, &fitness.Date, &fitness.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "dailyfitness" violates foreign key constraint "dailyfitness_user_id_fkey"`:
+			return ErrUnknownUser
+		case err.Error() == `pq: duplicate key value violates unique constraint "dailyfitness_user_id_local_date_key"`:
+			return ErrDuplicateRecord
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+//Upsert function that stores the users fitness for the day according to the
+//mode. It reports whether a new record was created, and on an update the
+//fitness struct is refreshed with the stored totals
+func (m FitnessModel) Upsert(fitness *Fitness, mode string) (bool, error) {
+	var set string
+	switch mode {
+	case UpsertCreate:
+		return true, m.Insert(fitness)
+	case UpsertReplace:
+		set = "steps = EXCLUDED.steps, cups = EXCLUDED.cups"
+	case UpsertAdd:
+		set = "steps = dailyfitness.steps + EXCLUDED.steps, cups = dailyfitness.cups + EXCLUDED.cups"
+	default:
+		panic("unknown upsert mode: " + mode)
+	}
+
+	//xmax is only zero on a row that this statement inserted
+	query := fmt.Sprintf(`
+		INSERT INTO dailyfitness (user_id, steps, cups, local_date)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, local_date)
+		DO UPDATE SET %s, version = dailyfitness.version + 1
+		RETURNING id, steps, cups, date, version, xmax = 0
+	`, set)
+	args := []interface{}{
+		fitness.User_id,
+		fitness.Steps,
+		fitness.Cups,
+		fitness.LocalDate,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&fitness.ID, &fitness.Date)
+	var created bool
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&fitness.ID,
+		&fitness.Steps,
+		&fitness.Cups,
+		&fitness.Date,
+		&fitness.Version,
+		&created,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "dailyfitness" violates foreign key constraint "dailyfitness_user_id_fkey"`:
+			return false, ErrUnknownUser
+		default:
+			return false, err
+		}
+	}
+	return created, nil
 }
 
-//Get all function that will list all the records stored
-func (m FitnessModel) GetAll(id int, user_id int, steps int, cups int, date time.Time, filters Filters ) ([]*Fitness, Metadata, error) {
+// Get() returns a specific fitness record based on its id
+func (m FitnessModel) Get(id int64) (*Fitness, error) {
+	// Ensure that there is a valid id
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, user_id, steps, cups, date, local_date::text, version
+		FROM dailyfitness
+		WHERE id = $1
+	`
+	var fitness Fitness
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&fitness.ID,
+		&fitness.User_id,
+		&fitness.Steps,
+		&fitness.Cups,
+		&fitness.Date,
+		&fitness.LocalDate,
+		&fitness.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &fitness, nil
+}
+
+// GetAllForUser() returns every fitness record of a user, oldest first, for
+// the data export
+func (m FitnessModel) GetAllForUser(userID int64) ([]*Fitness, error) {
+	query := `
+		SELECT id, user_id, steps, cups, date, local_date::text, version
+		FROM dailyfitness
+		WHERE user_id = $1
+		ORDER BY local_date, id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*Fitness{}
+	for rows.Next() {
+		var fitness Fitness
+		err := rows.Scan(
+			&fitness.ID,
+			&fitness.User_id,
+			&fitness.Steps,
+			&fitness.Cups,
+			&fitness.Date,
+			&fitness.LocalDate,
+			&fitness.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &fitness)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Update() allows us to edit/alter a specific fitness record
+// The version column guards against two clients editing the same record
+func (m FitnessModel) Update(fitness *Fitness) error {
+	query := `
+		UPDATE dailyfitness
+		SET steps = $1, cups = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version
+	`
+	args := []interface{}{
+		fitness.Steps,
+		fitness.Cups,
+		fitness.ID,
+		fitness.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&fitness.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// The WHERE clause shared by the listings. The FitnessQuery fields are bound
+// to $1 to $10 by the args() method
+const fitnessQueryWhere = `
+		WHERE (id = $1 OR $1 = 0)
+		AND (user_id = $2 OR $2 = 0)
+		AND ($3::integer IS NULL OR steps = $3)
+		AND ($4::integer IS NULL OR steps >= $4)
+		AND ($5::integer IS NULL OR steps <= $5)
+		AND ($6::integer IS NULL OR cups = $6)
+		AND ($7::integer IS NULL OR cups >= $7)
+		AND ($8::integer IS NULL OR cups <= $8)
+		AND ($9::date IS NULL OR local_date >= $9)
+		AND ($10::date IS NULL OR local_date < $10)`
+
+// The args() method returns the query arguments for fitnessQueryWhere
+func (q FitnessQuery) args() []interface{} {
+	return []interface{}{
+		q.ID,
+		q.UserID,
+		q.Steps,
+		q.StepsMin,
+		q.StepsMax,
+		q.Cups,
+		q.CupsMin,
+		q.CupsMax,
+		dateArg(q.From),
+		dateArg(q.To),
+	}
+}
+
+// The dateArg() function formats a time as a date query argument, or returns
+// nil so that the comparison can be skipped
+func dateArg(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02")
+}
+
+// The sortValue() method returns the value of a sortable column as the string
+// stored in a cursor
+func (f *Fitness) sortValue(column string) string {
+	switch column {
+	case "user_id":
+		return strconv.FormatInt(f.User_id, 10)
+	case "steps":
+		return strconv.Itoa(f.Steps)
+	case "cups":
+		return strconv.Itoa(f.Cups)
+	case "date":
+		return f.Date.Format(time.RFC3339Nano)
+	default:
+		return strconv.Itoa(f.ID)
+	}
+}
+
+//Get all function that will list the records matching the query
+//A UserID of 0 lists the records of every user and is reserved for admins
+//The To date is exclusive
+func (m FitnessModel) GetAll(q FitnessQuery, filters Filters) ([]*Fitness, Metadata, error) {
+	if filters.CursorMode {
+		return m.getAllByCursor(q, filters)
+	}
 	
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, user_id, steps, cups, date
+		SELECT COUNT(*) OVER(), id, user_id, steps, cups, date, local_date::text, version, goal_steps, goal_cups
 		FROM dailyfitness
-		WHERE (to_tsvector('simple', steps) @@ plainto_tsquery('simple',$1) OR $1 = '')
-		AND (to_tsvector('simple', cups) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		%s
+		%s
 		ORDER BY %s %s, id DESC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortOrder())
+		LIMIT $11 OFFSET $12`, fitnessGoalJoin, fitnessQueryWhere, filters.sortColumn(), filters.sortOrder())
 
 		// Create a 3-second-timout context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	// Execute the query
-	args := []interface{}{steps, cups, filters.limit(), filters.offset()}
+	args := append(q.args(), filters.limit(), filters.offset())
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -84,6 +409,7 @@ func (m FitnessModel) GetAll(id int, user_id int, steps int, cups int, date time
 	// Iterate over the rows in the resultset
 	for rows.Next() {
 		var fitness Fitness
+		var goalSteps, goalCups sql.NullInt64
 		// Scan the values from the row into school
 		err := rows.Scan(
 			&totalRecords,
@@ -92,10 +418,15 @@ func (m FitnessModel) GetAll(id int, user_id int, steps int, cups int, date time
 			&fitness.Steps,
 			&fitness.Cups,
 			&fitness.Date,
+			&fitness.LocalDate,
+			&fitness.Version,
+			&goalSteps,
+			&goalCups,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		fitness.Progress = newProgress(fitness.Steps, fitness.Cups, goalSteps, goalCups)
 		// Add the School to our slice
 		lists = append(lists, &fitness)
 	}
@@ -108,7 +439,168 @@ func (m FitnessModel) GetAll(id int, user_id int, steps int, cups int, date time
 	return lists, metadata, nil
 }
 
-// Delete() removes a specific record *only beingn used for testing*
+// getAllByCursor() lists the records after (or before) the position held in
+// filters.Cursor. Rows are located by the (sort column, id) pair so the cost
+// does not grow with the page number and no total count is computed
+func (m FitnessModel) getAllByCursor(q FitnessQuery, filters Filters) ([]*Fitness, Metadata, error) {
+	var after *cursor
+	if filters.Cursor != "" {
+		c, err := decodeCursor(filters.CursorKey, filters.Cursor)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		after = &c
+	}
+	backward := after != nil && after.Backward
+	column := filters.sortColumn()
+	order := filters.keysetOrder(backward)
+
+	args := q.args()
+	keyset := ""
+	if after != nil {
+		// Row comparison keeps the scan stable when sort values repeat
+		comparison := ">"
+		if order == "DESC" {
+			comparison = "<"
+		}
+		keyset = fmt.Sprintf("AND (%s, id) %s ($%d, $%d)", column, comparison, len(args)+1, len(args)+2)
+		args = append(args, after.Value, after.ID)
+	}
+	// Fetch one extra row to find out whether there is another page
+	args = append(args, filters.limit()+1)
+
+	query := fmt.Sprintf(`
+		SELECT id, user_id, steps, cups, date, local_date::text, version, goal_steps, goal_cups
+		FROM dailyfitness
+		%s
+		%s
+		%s
+		ORDER BY %s %s, id %s
+		LIMIT $%d`, fitnessGoalJoin, fitnessQueryWhere, keyset, column, order, order, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	lists := []*Fitness{}
+	for rows.Next() {
+		var fitness Fitness
+		var goalSteps, goalCups sql.NullInt64
+		err := rows.Scan(
+			&fitness.ID,
+			&fitness.User_id,
+			&fitness.Steps,
+			&fitness.Cups,
+			&fitness.Date,
+			&fitness.LocalDate,
+			&fitness.Version,
+			&goalSteps,
+			&goalCups,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		fitness.Progress = newProgress(fitness.Steps, fitness.Cups, goalSteps, goalCups)
+		lists = append(lists, &fitness)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	hasMore := len(lists) > filters.limit()
+	if hasMore {
+		lists = lists[:filters.limit()]
+	}
+	// A backward scan comes back in reverse, so put it in the requested order
+	if backward {
+		for i, j := 0, len(lists)-1; i < j; i, j = i+1, j-1 {
+			lists[i], lists[j] = lists[j], lists[i]
+		}
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+	if len(lists) == 0 {
+		return lists, metadata, nil
+	}
+	// There is a next page if we are walking forward and found an extra row,
+	// or if we walked backward from a later position
+	if backward || hasMore {
+		last := lists[len(lists)-1]
+		metadata.NextCursor, err = encodeCursor(filters.CursorKey, cursor{Sort: filters.Sort, Value: last.sortValue(column), ID: last.ID})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+	if (backward && hasMore) || (!backward && after != nil) {
+		first := lists[0]
+		metadata.PrevCursor, err = encodeCursor(filters.CursorKey, cursor{Sort: filters.Sort, Value: first.sortValue(column), ID: first.ID, Backward: true})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+	return lists, metadata, nil
+}
+
+// GetStats() groups a user's records into buckets of the given period and
+// computes the totals, averages, minimums and maximums in the database.
+// Buckets follow the local date of the records, which is the user's own
+// calendar day; week buckets start on Monday as ISO weeks do. Nil from and
+// to leave the range open, and to is exclusive
+func (m FitnessModel) GetStats(userID int64, period string, from *time.Time, to *time.Time) ([]*FitnessStats, error) {
+	query := `
+		SELECT date_trunc($1, local_date) AS bucket, COUNT(*),
+			SUM(steps), AVG(steps), MIN(steps), MAX(steps),
+			SUM(cups), AVG(cups), MIN(cups), MAX(cups)
+		FROM dailyfitness
+		WHERE user_id = $2
+		AND ($3::date IS NULL OR local_date >= $3)
+		AND ($4::date IS NULL OR local_date < $4)
+		GROUP BY bucket
+		ORDER BY bucket
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, period, userID, dateArg(from), dateArg(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []*FitnessStats{}
+	for rows.Next() {
+		var bucket time.Time
+		var s FitnessStats
+		err := rows.Scan(
+			&bucket,
+			&s.Records,
+			&s.Steps.Total,
+			&s.Steps.Average,
+			&s.Steps.Min,
+			&s.Steps.Max,
+			&s.Cups.Total,
+			&s.Cups.Average,
+			&s.Cups.Min,
+			&s.Cups.Max,
+		)
+		if err != nil {
+			return nil, err
+		}
+		s.Start = bucket.Format("2006-01-02")
+		stats = append(stats, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Delete() removes a specific fitness record
 func (m FitnessModel) Delete(id int64) error {
 	// Ensure that there is a valid id
 	if id < 1 {
@@ -0,0 +1,204 @@
+// Filename: internal/data/goals.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"fitness.zioncastillo.net/internal/validator"
+)
+
+// A Goal is a user's daily target for steps and cups. It applies from its
+// effective date until a goal with a later effective date replaces it
+type Goal struct {
+	ID            int64     `json:"id"`
+	UserID        int64     `json:"-"`
+	Steps         int       `json:"steps"`
+	Cups          int       `json:"cups"`
+	EffectiveFrom string    `json:"effective_from"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Progress compares a day's totals against the goal in effect that day
+type Progress struct {
+	StepsGoal    int     `json:"steps_goal"`
+	CupsGoal     int     `json:"cups_goal"`
+	StepsPercent float64 `json:"steps_percent"`
+	CupsPercent  float64 `json:"cups_percent"`
+}
+
+// DayProgress holds a user's totals and goal progress for one local date
+type DayProgress struct {
+	Date     string    `json:"date"`
+	Steps    int       `json:"steps"`
+	Cups     int       `json:"cups"`
+	Progress *Progress `json:"progress"`
+}
+
+// ValidateGoal() checks a goal before it is saved. Goals cannot be backdated,
+// so effective_from must not be before today, the user's local date
+func ValidateGoal(v *validator.Validator, goal *Goal, today string) {
+	v.Check(goal.Steps >= 0, "steps", "cannot be less than 0")
+	v.Check(goal.Steps <= 100000, "steps", "must not be more than 100000")
+	v.Check(goal.Cups >= 0, "cups", "cannot be less than 0")
+	v.Check(goal.Cups <= 100, "cups", "must not be more than 100")
+	v.Check(goal.Steps > 0 || goal.Cups > 0, "goal", "must set steps or cups")
+	_, err := time.Parse("2006-01-02", goal.EffectiveFrom)
+	v.Check(err == nil, "effective_from", "must be a date in the format YYYY-MM-DD")
+	// Dates in this format sort in calendar order
+	if err == nil {
+		v.Check(goal.EffectiveFrom >= today, "effective_from", "must not be before today")
+	}
+}
+
+// The newProgress() function works out the percentages for a day. It returns
+// nil when no goal was in effect. A goal of zero counts as met
+func newProgress(steps int, cups int, goalSteps sql.NullInt64, goalCups sql.NullInt64) *Progress {
+	if !goalSteps.Valid || !goalCups.Valid {
+		return nil
+	}
+	progress := &Progress{
+		StepsGoal:    int(goalSteps.Int64),
+		CupsGoal:     int(goalCups.Int64),
+		StepsPercent: 100,
+		CupsPercent:  100,
+	}
+	if progress.StepsGoal > 0 {
+		progress.StepsPercent = float64(steps) / float64(progress.StepsGoal) * 100
+	}
+	if progress.CupsGoal > 0 {
+		progress.CupsPercent = float64(cups) / float64(progress.CupsGoal) * 100
+	}
+	return progress
+}
+
+// The goal in effect on each dailyfitness row, exposed as goal_steps and
+// goal_cups for the listings to join against
+const fitnessGoalJoin = `
+		LEFT JOIN LATERAL (
+			SELECT goals.steps AS goal_steps, goals.cups AS goal_cups
+			FROM goals
+			WHERE goals.user_id = dailyfitness.user_id
+			AND goals.effective_from <= dailyfitness.local_date
+			ORDER BY goals.effective_from DESC
+			LIMIT 1
+		) AS goal ON true`
+
+// Define the Goal model
+type GoalModel struct {
+	DB *sql.DB
+}
+
+// Set() stores a goal. Setting a goal twice for the same effective date
+// replaces the earlier one
+func (m GoalModel) Set(goal *Goal) error {
+	query := `
+		INSERT INTO goals (user_id, steps, cups, effective_from)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, effective_from)
+		DO UPDATE SET steps = EXCLUDED.steps, cups = EXCLUDED.cups, created_at = NOW()
+		RETURNING id, created_at
+	`
+	args := []interface{}{
+		goal.UserID,
+		goal.Steps,
+		goal.Cups,
+		goal.EffectiveFrom,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&goal.ID, &goal.CreatedAt)
+}
+
+// GetAllForUser() returns a user's goals, the most recent first
+func (m GoalModel) GetAllForUser(userID int64) ([]*Goal, error) {
+	query := `
+		SELECT id, user_id, steps, cups, effective_from::text, created_at
+		FROM goals
+		WHERE user_id = $1
+		ORDER BY effective_from DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	goals := []*Goal{}
+	for rows.Next() {
+		var goal Goal
+		err := rows.Scan(
+			&goal.ID,
+			&goal.UserID,
+			&goal.Steps,
+			&goal.Cups,
+			&goal.EffectiveFrom,
+			&goal.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		goals = append(goals, &goal)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return goals, nil
+}
+
+// GetProgress() returns the progress for every day from the from date to the
+// to date inclusive. Days without a record count as zero steps and cups
+func (m GoalModel) GetProgress(userID int64, from time.Time, to time.Time) ([]*DayProgress, error) {
+	query := `
+		SELECT day::date::text, COALESCE(dailyfitness.steps, 0), COALESCE(dailyfitness.cups, 0),
+			goal.goal_steps, goal.goal_cups
+		FROM generate_series($2::date, $3::date, interval '1 day') AS day
+		LEFT JOIN dailyfitness
+		ON dailyfitness.user_id = $1 AND dailyfitness.local_date = day::date
+		LEFT JOIN LATERAL (
+			SELECT goals.steps AS goal_steps, goals.cups AS goal_cups
+			FROM goals
+			WHERE goals.user_id = $1
+			AND goals.effective_from <= day::date
+			ORDER BY goals.effective_from DESC
+			LIMIT 1
+		) AS goal ON true
+		ORDER BY day
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []*DayProgress{}
+	for rows.Next() {
+		var day DayProgress
+		var goalSteps, goalCups sql.NullInt64
+		err := rows.Scan(
+			&day.Date,
+			&day.Steps,
+			&day.Cups,
+			&goalSteps,
+			&goalCups,
+		)
+		if err != nil {
+			return nil, err
+		}
+		day.Progress = newProgress(day.Steps, day.Cups, goalSteps, goalCups)
+		days = append(days, &day)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return days, nil
+}
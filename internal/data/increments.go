@@ -0,0 +1,246 @@
+// Filename: internal/data/increments.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"fitness.zioncastillo.net/internal/validator"
+)
+
+// An Increment is a small amount of steps or cups logged during the day. The
+// increments live in the tempsteps and tempcups tables until they are rolled
+// up into the user's dailyfitness record
+type Increment struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Steps     int       `json:"steps,omitempty"`
+	Cups      int       `json:"cups,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DailyTotal is the running total of a user's steps and cups for one day
+type DailyTotal struct {
+	Date  string `json:"date"`
+	Steps int    `json:"steps"`
+	Cups  int    `json:"cups"`
+}
+
+func ValidateStepsIncrement(v *validator.Validator, steps int) {
+	v.Check(steps > 0, "steps", "must be greater than zero")
+	v.Check(steps <= 100000, "steps", "must not be more than 100000")
+}
+
+func ValidateCupsIncrement(v *validator.Validator, cups int) {
+	v.Check(cups > 0, "cups", "must be greater than zero")
+	v.Check(cups <= 100, "cups", "must not be more than 100")
+}
+
+// Define the Increment model
+type IncrementModel struct {
+	DB *sql.DB
+}
+
+// InsertSteps() logs a steps increment in the tempsteps table
+func (m IncrementModel) InsertSteps(increment *Increment) error {
+	query := `
+		INSERT INTO tempsteps (user_id, steps)
+		VALUES ($1, $2)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, increment.UserID, increment.Steps).Scan(&increment.ID, &increment.CreatedAt)
+}
+
+// InsertCups() logs a cups increment in the tempcups table
+func (m IncrementModel) InsertCups(increment *Increment) error {
+	query := `
+		INSERT INTO tempcups (user_id, cups)
+		VALUES ($1, $2)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, increment.UserID, increment.Cups).Scan(&increment.ID, &increment.CreatedAt)
+}
+
+// GetStepsForUser() returns the steps increments of a user that have not
+// been rolled up yet, oldest first
+func (m IncrementModel) GetStepsForUser(userID int64) ([]*Increment, error) {
+	return m.getAllForUser("tempsteps", "steps", userID)
+}
+
+// GetCupsForUser() returns the cups increments of a user that have not been
+// rolled up yet, oldest first
+func (m IncrementModel) GetCupsForUser(userID int64) ([]*Increment, error) {
+	return m.getAllForUser("tempcups", "cups", userID)
+}
+
+// The getAllForUser() method reads the increments of a user from table. The
+// table and column names are our own and never come from a client
+func (m IncrementModel) getAllForUser(table string, column string, userID int64) ([]*Increment, error) {
+	query := fmt.Sprintf(`
+		SELECT id, user_id, %s, created_at
+		FROM %s
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`, column, table)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	increments := []*Increment{}
+	for rows.Next() {
+		var increment Increment
+		value := &increment.Steps
+		if column == "cups" {
+			value = &increment.Cups
+		}
+		err := rows.Scan(&increment.ID, &increment.UserID, value, &increment.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		increments = append(increments, &increment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return increments, nil
+}
+
+// GetTotal() adds up a user's dailyfitness record for the local date of start
+// and the increments logged between start and end that have not been rolled
+// up yet
+func (m IncrementModel) GetTotal(userID int64, start time.Time, end time.Time) (*DailyTotal, error) {
+	query := `
+		SELECT
+			(SELECT COALESCE(SUM(steps), 0) FROM dailyfitness
+				WHERE user_id = $1 AND local_date = $4) +
+			(SELECT COALESCE(SUM(steps), 0) FROM tempsteps
+				WHERE user_id = $1 AND created_at >= $2 AND created_at < $3),
+			(SELECT COALESCE(SUM(cups), 0) FROM dailyfitness
+				WHERE user_id = $1 AND local_date = $4) +
+			(SELECT COALESCE(SUM(cups), 0) FROM tempcups
+				WHERE user_id = $1 AND created_at >= $2 AND created_at < $3)
+	`
+	total := DailyTotal{Date: start.Format("2006-01-02")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, start, end, total.Date).Scan(&total.Steps, &total.Cups)
+	if err != nil {
+		return nil, err
+	}
+	return &total, nil
+}
+
+// RollUp() moves every increment logged before today into the dailyfitness
+// table, adding them to the user's record for the day they were logged on.
+// Both today and the day are worked out in the user's own time zone, as of
+// now, so the current local day is never rolled up and every increment lands
+// on the day GetTotal() reads it back under. The increments are deleted in
+// the same transaction so that concurrent roll-ups cannot count them twice.
+// It returns the number of daily records that were touched
+func (m IncrementModel) RollUp(now time.Time) (int, error) {
+	type key struct {
+		userID int64
+		day    string
+	}
+	type rollUp struct {
+		userID int64
+		day    time.Time
+		steps  int
+		cups   int
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	totals := make(map[key]*rollUp)
+	// Claim and sum the increments of both tables
+	for _, table := range []string{"tempsteps", "tempcups"} {
+		column := "steps"
+		if table == "tempcups" {
+			column = "cups"
+		}
+		rows, err := tx.QueryContext(ctx, `
+			DELETE FROM `+table+`
+			USING users
+			WHERE `+table+`.user_id = users.id
+			AND `+table+`.created_at < date_trunc('day', $1::timestamptz AT TIME ZONE users.time_zone) AT TIME ZONE users.time_zone
+			RETURNING `+table+`.user_id, `+table+`.`+column+`, `+table+`.created_at, users.time_zone`, now)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var userID int64
+			var amount int
+			var createdAt time.Time
+			var timeZone string
+			err := rows.Scan(&userID, &amount, &createdAt, &timeZone)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+			location, err := time.LoadLocation(timeZone)
+			if err != nil {
+				location = time.UTC
+			}
+			local := createdAt.In(location)
+			day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+			k := key{userID: userID, day: day.Format("2006-01-02")}
+			if _, found := totals[k]; !found {
+				totals[k] = &rollUp{userID: userID, day: day}
+			}
+			if column == "steps" {
+				totals[k].steps += amount
+			} else {
+				totals[k].cups += amount
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, total := range totals {
+		// Add to the record for that day, or create it if there is none
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO dailyfitness (user_id, steps, cups, date, local_date)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, local_date)
+			DO UPDATE SET steps = dailyfitness.steps + EXCLUDED.steps,
+				cups = dailyfitness.cups + EXCLUDED.cups,
+				version = dailyfitness.version + 1`,
+			total.userID, total.steps, total.cups, total.day, total.day.Format("2006-01-02"))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return len(totals), nil
+}
@@ -0,0 +1,178 @@
+// Filename: internal/data/logins.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// A LoginFailure tracks the failed logins with an email address since its
+// last successful one. Addresses without an account are tracked too, so that
+// they are held back just like real ones and cannot be told apart
+type LoginFailure struct {
+	Email         string     `json:"-"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// LoginPolicy decides how long an account has to wait between failed logins
+type LoginPolicy struct {
+	MaxFailures int           // failures in a row that lock the account
+	Backoff     time.Duration // wait after the first failure, doubled after each one
+	Lockout     time.Duration // how long a locked account stays locked
+}
+
+// RetryAfter() returns how long the account has to wait before the next
+// login attempt, or zero if it may try now. While it is not locked the wait
+// doubles with each failure, but never exceeds the lockout
+func (f *LoginFailure) RetryAfter(now time.Time, policy LoginPolicy) time.Duration {
+	if f == nil {
+		return 0
+	}
+	if f.LockedUntil != nil && now.Before(*f.LockedUntil) {
+		return f.LockedUntil.Sub(now)
+	}
+	if f.Failures == 0 {
+		return 0
+	}
+	wait := policy.Backoff
+	for i := 1; i < f.Failures && wait < policy.Lockout; i++ {
+		wait *= 2
+	}
+	if wait > policy.Lockout {
+		wait = policy.Lockout
+	}
+	if next := f.LastFailureAt.Add(wait); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Define the LoginFailure model
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the failed logins with an email address, or nil if there
+// are none
+func (m LoginFailureModel) Get(email string) (*LoginFailure, error) {
+	query := `
+		SELECT email, failures, last_failure_at, locked_until
+		FROM login_failures
+		WHERE email = $1
+	`
+	var failure LoginFailure
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&failure.Email,
+		&failure.Failures,
+		&failure.LastFailureAt,
+		&failure.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return &failure, nil
+}
+
+// RecordFailure() counts a failed login. When the count reaches the policy's
+// maximum the account is locked and the count starts over. The returned bool
+// is true only for the failure that locked the account, so that the owner is
+// told once
+func (m LoginFailureModel) RecordFailure(email string, policy LoginPolicy) (*LoginFailure, bool, error) {
+	// A lock that has run out no longer counts
+	query := `
+		INSERT INTO login_failures (email, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (email) DO UPDATE
+		SET failures = login_failures.failures + 1, last_failure_at = NOW(),
+			locked_until = CASE WHEN login_failures.locked_until > NOW() THEN login_failures.locked_until END
+		RETURNING email, failures, last_failure_at, locked_until
+	`
+	var failure LoginFailure
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&failure.Email,
+		&failure.Failures,
+		&failure.LastFailureAt,
+		&failure.LockedUntil,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if failure.Failures < policy.MaxFailures || failure.LockedUntil != nil {
+		return &failure, false, nil
+	}
+
+	// Only one of several concurrent failures gets to lock the account
+	query = `
+		UPDATE login_failures
+		SET failures = 0, locked_until = NOW() + $2 * interval '1 second'
+		WHERE email = $1 AND failures >= $3 AND (locked_until IS NULL OR locked_until <= NOW())
+		RETURNING failures, locked_until
+	`
+	err = m.DB.QueryRowContext(ctx, query, email, policy.Lockout.Seconds(), policy.MaxFailures).Scan(
+		&failure.Failures,
+		&failure.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &failure, false, nil
+		default:
+			return nil, false, err
+		}
+	}
+	return &failure, true, nil
+}
+
+// Reset() forgets the failed logins with an email address, which also
+// unlocks it
+func (m LoginFailureModel) Reset(email string) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE email = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
+
+// DeleteExpired() forgets the failed logins that are not locked and last
+// failed longer ago than the lockout, which no wait can outlast. Without it
+// the addresses that have no account would pile up. It returns how many were
+// forgotten
+func (m LoginFailureModel) DeleteExpired(policy LoginPolicy) (int, error) {
+	query := `
+		DELETE FROM login_failures
+		WHERE (locked_until IS NULL OR locked_until <= NOW())
+		AND last_failure_at <= NOW() - $1 * interval '1 second'
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, policy.Lockout.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginFailureRetryAfter(t *testing.T) {
+	policy := LoginPolicy{MaxFailures: 5, Backoff: time.Second, Lockout: 15 * time.Minute}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	lockedUntil := func(d time.Duration) *time.Time {
+		until := now.Add(d)
+		return &until
+	}
+
+	tests := []struct {
+		name    string
+		failure *LoginFailure
+		policy  LoginPolicy
+		want    time.Duration
+	}{
+		{
+			name:    "no failures",
+			failure: nil,
+			policy:  policy,
+			want:    0,
+		},
+		{
+			name:    "failure count reset",
+			failure: &LoginFailure{Failures: 0, LastFailureAt: now},
+			policy:  policy,
+			want:    0,
+		},
+		{
+			name:    "first failure waits the backoff",
+			failure: &LoginFailure{Failures: 1, LastFailureAt: now},
+			policy:  policy,
+			want:    time.Second,
+		},
+		{
+			name:    "wait doubles with each failure",
+			failure: &LoginFailure{Failures: 4, LastFailureAt: now},
+			policy:  policy,
+			want:    8 * time.Second,
+		},
+		{
+			name:    "time already waited is taken off",
+			failure: &LoginFailure{Failures: 3, LastFailureAt: now.Add(-time.Second)},
+			policy:  policy,
+			want:    3 * time.Second,
+		},
+		{
+			name:    "backoff over",
+			failure: &LoginFailure{Failures: 3, LastFailureAt: now.Add(-4 * time.Second)},
+			policy:  policy,
+			want:    0,
+		},
+		{
+			name:    "wait never exceeds the lockout",
+			failure: &LoginFailure{Failures: 40, LastFailureAt: now},
+			policy:  policy,
+			want:    15 * time.Minute,
+		},
+		{
+			name:    "locked",
+			failure: &LoginFailure{Failures: 5, LastFailureAt: now, LockedUntil: lockedUntil(10 * time.Minute)},
+			policy:  policy,
+			want:    10 * time.Minute,
+		},
+		{
+			name:    "lock expired falls back to the backoff",
+			failure: &LoginFailure{Failures: 1, LastFailureAt: now.Add(-time.Hour), LockedUntil: lockedUntil(-time.Minute)},
+			policy:  policy,
+			want:    0,
+		},
+		{
+			name:    "no backoff configured",
+			failure: &LoginFailure{Failures: 3, LastFailureAt: now},
+			policy:  LoginPolicy{MaxFailures: 5, Lockout: 15 * time.Minute},
+			want:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.failure.RetryAfter(now, tt.policy)
+			if got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -14,18 +15,34 @@ var (
 
 // A wrapper for our data models
 type Models struct {
+	APIKeys APIKeyModel
 	Permissions PermissionModel
 	Fitness FitnessModel
+	Goals GoalModel
+	Increments IncrementModel
+	LoginFailures LoginFailureModel
+	Roles RoleModel
 	Tokens TokenModel
+	TOTP TOTPModel
 	Users UserModel
 }
 
-// NewModels() allows us to create a new Models
-func NewModels(db *sql.DB) Models {
+// NewModels() allows us to create a new Models. Effective permissions are
+// cached for permissionsTTL, or not at all when it is zero. Revoked JWTs are
+// denied for jwtTTL, which is zero when JWTs are not issued
+func NewModels(db *sql.DB, permissionsTTL time.Duration, jwtTTL time.Duration) Models {
+	cache := NewPermissionCache(permissionsTTL)
+	denylist := NewTokenDenylist(jwtTTL)
 	return Models{
-		Permissions: PermissionModel{DB: db},
+		APIKeys: APIKeyModel{DB: db},
+		Permissions: PermissionModel{DB: db, Cache: cache, Denylist: denylist},
 		Fitness: FitnessModel{DB: db},
-		Tokens: TokenModel{DB: db},
+		Goals: GoalModel{DB: db},
+		Increments: IncrementModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		Roles: RoleModel{DB: db, Cache: cache, Denylist: denylist},
+		Tokens: TokenModel{DB: db, Denylist: denylist},
+		TOTP: TOTPModel{DB: db},
 		Users: UserModel{DB: db},
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"time"
 
+	"fitness.zioncastillo.net/internal/validator"
 	"github.com/lib/pq"
 )
 
@@ -22,19 +23,96 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// ValidatePermissionCodes checks that codes is a non-empty list of codes that
+// exist in the permissions table, which are passed in as known
+func ValidatePermissionCodes(v *validator.Validator, codes []string, known Permissions) {
+	v.Check(len(codes) > 0, "codes", "must contain at least one permission")
+	v.Check(validator.Unique(codes), "codes", "must not contain duplicate values")
+	for _, code := range codes {
+		v.Check(known.Include(code), "codes", "must only contain known permissions")
+	}
+}
+
+// Returns the codes that appear in both slices
+func (p Permissions) Intersect(codes []string) Permissions {
+	var permissions Permissions
+	for i := range codes {
+		if p.Include(codes[i]) {
+			permissions = append(permissions, codes[i])
+		}
+	}
+	return permissions
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Cache    *PermissionCache
+	Denylist *TokenDenylist
+}
+
+// GetAll() returns every permission code in the permissions table
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+	     SELECT code
+		 FROM permissions
+		 ORDER BY code
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
 }
 
+// GetAllForUser() returns the effective permissions of a user, which are the
+// codes granted to the user directly and those of every role the user holds.
+// Results are served from the cache while they are fresh
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	permissions, version, ok := m.Cache.get(userID)
+	if ok {
+		return permissions, nil
+	}
+	permissions, err := m.getAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	m.Cache.set(userID, permissions, version)
+	return permissions, nil
+}
+
+// The getAllForUser() method reads the effective permissions of a user from the database
+func (m PermissionModel) getAllForUser(userID int64) (Permissions, error) {
 	query := `
 	     SELECT permissions.code
 		 FROM permissions
-		 INNER JOIN users_permissions
-		 ON users_permissions.permission_id = permissions.id
-		 INNER JOIN users
-		 ON users_permissions.user_id = users.id
-		 WHERE users.id = $1
+		 WHERE permissions.id IN (
+		     SELECT users_permissions.permission_id
+			 FROM users_permissions
+			 WHERE users_permissions.user_id = $1
+			 UNION
+			 SELECT roles_permissions.permission_id
+			 FROM roles_permissions
+			 INNER JOIN users_roles
+			 ON users_roles.role_id = roles_permissions.role_id
+			 WHERE users_roles.user_id = $1
+		 )
+		 ORDER BY permissions.code
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -59,14 +137,115 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permisisons, nil
 }
 
+// GetGrantedForUser() returns only the codes granted to a user directly
+func (m PermissionModel) GetGrantedForUser(userID int64) (Permissions, error) {
+	query := `
+	     SELECT permissions.code
+		 FROM permissions
+		 INNER JOIN users_permissions
+		 ON users_permissions.permission_id = permissions.id
+		 WHERE users_permissions.user_id = $1
+		 ORDER BY permissions.code
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 	      INSERT INTO users_permissions
-		  SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)	 
+		  SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		  ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	m.Cache.Invalidate(userID)
+	m.Denylist.RevokeUser(userID)
+	return err
+}
+
+// RemoveForUser() revokes the given codes from a user
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+	      DELETE FROM users_permissions
+		  USING permissions
+		  WHERE users_permissions.permission_id = permissions.id
+		  AND users_permissions.user_id = $1
+		  AND permissions.code = ANY($2)
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	m.Cache.Invalidate(userID)
+	m.Denylist.RevokeUser(userID)
 	return err
-}
\ No newline at end of file
+}
+
+// GetUsersForCode() lists the users that hold a permission code, either
+// directly or through a role
+func (m PermissionModel) GetUsersForCode(code string) ([]*User, error) {
+	query := `
+	     SELECT ` + userColumns + `
+		 FROM users
+		 WHERE users.deleted_at IS NULL
+		 AND users.id IN (
+		     SELECT users_permissions.user_id
+			 FROM users_permissions
+			 INNER JOIN permissions
+			 ON users_permissions.permission_id = permissions.id
+			 WHERE permissions.code = $1
+			 UNION
+			 SELECT users_roles.user_id
+			 FROM users_roles
+			 INNER JOIN roles_permissions
+			 ON roles_permissions.role_id = users_roles.role_id
+			 INNER JOIN permissions
+			 ON roles_permissions.permission_id = permissions.id
+			 WHERE permissions.code = $1
+		 )
+		 ORDER BY users.id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(user.scanDest()...)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
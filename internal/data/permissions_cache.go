@@ -0,0 +1,122 @@
+// Filename: internal/data/permissions_cache.go
+
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A PermissionCache holds the effective permissions of recently seen users so
+// that protected requests do not have to query them every time. A nil cache is
+// valid and caches nothing
+type PermissionCache struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	entries   map[int64]permissionCacheEntry
+	version   uint64
+	lastSweep time.Time
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expires     time.Time
+}
+
+// PermissionCacheStats reports how well the cache is doing
+type PermissionCacheStats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Size    int     `json:"size"`
+}
+
+// NewPermissionCache() returns a cache whose entries live for ttl, or nil when
+// ttl is not positive, which turns caching off
+func NewPermissionCache(ttl time.Duration) *PermissionCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &PermissionCache{
+		ttl:       ttl,
+		entries:   make(map[int64]permissionCacheEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// The get() method returns the cached permissions of a user. On a miss it also
+// returns the version that must be passed to set(), so that a value loaded
+// while the user was being invalidated is never stored
+func (c *PermissionCache) get(userID int64) (Permissions, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if ok && time.Now().Before(entry.expires) {
+		c.hits.Add(1)
+		return entry.permissions, c.version, true
+	}
+	if ok {
+		delete(c.entries, userID)
+	}
+	c.misses.Add(1)
+	return nil, c.version, false
+}
+
+// The set() method stores the permissions of a user loaded at version
+func (c *PermissionCache) set(userID int64, permissions Permissions, version uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		return
+	}
+	now := time.Now()
+	// Drop expired entries now and then so users who went away do not pile up
+	if now.Sub(c.lastSweep) > c.ttl {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[userID] = permissionCacheEntry{permissions: permissions, expires: now.Add(c.ttl)}
+}
+
+// Invalidate() forgets the permissions of a user
+func (c *PermissionCache) Invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	delete(c.entries, userID)
+}
+
+// Stats() returns the hit and miss counts since the server started
+func (c *PermissionCache) Stats() PermissionCacheStats {
+	if c == nil {
+		return PermissionCacheStats{}
+	}
+	c.mu.Lock()
+	size := len(c.entries)
+	c.mu.Unlock()
+	stats := PermissionCacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
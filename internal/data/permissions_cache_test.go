@@ -0,0 +1,138 @@
+// Filename: internal/data/permissions_cache_test.go
+
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPermissionCache(t *testing.T) {
+	permissions := Permissions{"dailyfitness:read"}
+
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		steps     func(c *PermissionCache)
+		userID    int64
+		wantFound bool
+		wantStats PermissionCacheStats
+	}{
+		{
+			name: "hit after set",
+			ttl:  time.Minute,
+			steps: func(c *PermissionCache) {
+				_, version, _ := c.get(1)
+				c.set(1, permissions, version)
+			},
+			userID:    1,
+			wantFound: true,
+			wantStats: PermissionCacheStats{Hits: 1, Misses: 1, HitRate: 0.5, Size: 1},
+		},
+		{
+			name: "invalidated",
+			ttl:  time.Minute,
+			steps: func(c *PermissionCache) {
+				_, version, _ := c.get(1)
+				c.set(1, permissions, version)
+				c.Invalidate(1)
+			},
+			userID:    1,
+			wantFound: false,
+			wantStats: PermissionCacheStats{Misses: 2},
+		},
+		{
+			name: "stale set after invalidate",
+			ttl:  time.Minute,
+			steps: func(c *PermissionCache) {
+				// The permissions were loaded before the change landed
+				_, version, _ := c.get(1)
+				c.Invalidate(1)
+				c.set(1, permissions, version)
+			},
+			userID:    1,
+			wantFound: false,
+			wantStats: PermissionCacheStats{Misses: 2},
+		},
+		{
+			name: "set after invalidate with a fresh version",
+			ttl:  time.Minute,
+			steps: func(c *PermissionCache) {
+				c.Invalidate(1)
+				_, version, _ := c.get(1)
+				c.set(1, permissions, version)
+			},
+			userID:    1,
+			wantFound: true,
+			wantStats: PermissionCacheStats{Hits: 1, Misses: 1, HitRate: 0.5, Size: 1},
+		},
+		{
+			name: "expired",
+			ttl:  time.Minute,
+			steps: func(c *PermissionCache) {
+				_, version, _ := c.get(1)
+				c.set(1, permissions, version)
+				entry := c.entries[1]
+				entry.expires = time.Now().Add(-time.Second)
+				c.entries[1] = entry
+			},
+			userID:    1,
+			wantFound: false,
+			wantStats: PermissionCacheStats{Misses: 2},
+		},
+		{
+			name: "other users are not affected",
+			ttl:  time.Minute,
+			steps: func(c *PermissionCache) {
+				_, version, _ := c.get(1)
+				c.set(1, permissions, version)
+			},
+			userID:    2,
+			wantFound: false,
+			wantStats: PermissionCacheStats{Misses: 2, Size: 1},
+		},
+		{
+			name: "ttl of zero turns caching off",
+			ttl:  0,
+			steps: func(c *PermissionCache) {
+				_, version, _ := c.get(1)
+				c.set(1, permissions, version)
+				c.Invalidate(1)
+				c.set(1, permissions, version)
+			},
+			userID:    1,
+			wantFound: false,
+			wantStats: PermissionCacheStats{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewPermissionCache(tt.ttl)
+			tt.steps(c)
+			got, _, found := c.get(tt.userID)
+			if found != tt.wantFound {
+				t.Fatalf("found = %t; want %t", found, tt.wantFound)
+			}
+			if found && !equalPermissions(got, permissions) {
+				t.Errorf("got %v; want %v", got, permissions)
+			}
+			if stats := c.Stats(); stats != tt.wantStats {
+				t.Errorf("got stats %+v; want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
+
+// The equalPermissions() function reports whether two permission lists match
+func equalPermissions(a Permissions, b Permissions) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
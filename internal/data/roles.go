@@ -0,0 +1,150 @@
+// Filename: internal/data/roles.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"fitness.zioncastillo.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+// The roles every new user is assigned on signup
+var DefaultRoles = []string{"athlete"}
+
+// A Role is a named bundle of permission codes
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// ValidateRoleNames checks that names is a non-empty list of roles that exist,
+// which are passed in as known
+func ValidateRoleNames(v *validator.Validator, names []string, known []*Role) {
+	v.Check(len(names) > 0, "roles", "must contain at least one role")
+	v.Check(validator.Unique(names), "roles", "must not contain duplicate values")
+	for _, name := range names {
+		found := false
+		for _, role := range known {
+			if role.Name == name {
+				found = true
+				break
+			}
+		}
+		v.Check(found, "roles", "must only contain known roles")
+	}
+}
+
+// Define the Role model
+type RoleModel struct {
+	DB       *sql.DB
+	Cache    *PermissionCache
+	Denylist *TokenDenylist
+}
+
+// GetAll() returns every role along with its permission codes
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+	     SELECT roles.id, roles.name,
+		     COALESCE(array_agg(permissions.code ORDER BY permissions.code)
+			     FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		 FROM roles
+		 LEFT JOIN roles_permissions
+		 ON roles_permissions.role_id = roles.id
+		 LEFT JOIN permissions
+		 ON roles_permissions.permission_id = permissions.id
+		 GROUP BY roles.id
+		 ORDER BY roles.name
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.ID, &role.Name, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetAllForUser() returns the names of the roles a user holds
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+	     SELECT roles.name
+		 FROM roles
+		 INNER JOIN users_roles
+		 ON users_roles.role_id = roles.id
+		 WHERE users_roles.user_id = $1
+		 ORDER BY roles.name
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// AddForUser() assigns roles to a user. Roles the user already holds are kept
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+	      INSERT INTO users_roles
+		  SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		  ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	m.Cache.Invalidate(userID)
+	m.Denylist.RevokeUser(userID)
+	return err
+}
+
+// RemoveForUser() takes roles away from a user
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+	      DELETE FROM users_roles
+		  USING roles
+		  WHERE users_roles.role_id = roles.id
+		  AND users_roles.user_id = $1
+		  AND roles.name = ANY($2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	m.Cache.Invalidate(userID)
+	m.Denylist.RevokeUser(userID)
+	return err
+}
@@ -0,0 +1,122 @@
+// Filename: internal/data/streaks.go
+
+package data
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// A Streak describes the runs of consecutive days on which a user met their
+// goal for one metric. The start dates are empty when the streak is zero
+type Streak struct {
+	Current      int    `json:"current"`
+	CurrentStart string `json:"current_start,omitempty"`
+	Longest      int    `json:"longest"`
+	LongestStart string `json:"longest_start,omitempty"`
+}
+
+// Streaks holds a user's streak for each metric
+type Streaks struct {
+	Steps Streak `json:"steps"`
+	Cups  Streak `json:"cups"`
+}
+
+// LocalDate() returns the calendar day that now falls on in location, as
+// midnight UTC, which is the form local dates are compared in
+func LocalDate(now time.Time, location *time.Location) time.Time {
+	local := now.In(location)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// CalculateStreak() works out the streaks from the dates on which the goal
+// was met. Dates are calendar days at midnight UTC and today is the user's
+// current local date. A day with no record breaks a streak, but today does
+// not: until it is over, a streak that reached yesterday is still current.
+// Dates after today are ignored
+func CalculateStreak(days []time.Time, today time.Time) Streak {
+	days = append([]time.Time(nil), days...)
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	var streak Streak
+	var run int
+	var runStart, last time.Time
+	for _, day := range days {
+		if day.After(today) {
+			break
+		}
+		switch {
+		case run > 0 && day.Equal(last):
+			// The same day twice adds nothing
+			continue
+		case run > 0 && day.Equal(last.AddDate(0, 0, 1)):
+			run++
+		default:
+			run = 1
+			runStart = day
+		}
+		last = day
+		if run > streak.Longest {
+			streak.Longest = run
+			streak.LongestStart = runStart.Format("2006-01-02")
+		}
+	}
+
+	// The last run is only current if it reaches today or yesterday
+	if run > 0 && !last.Before(today.AddDate(0, 0, -1)) {
+		streak.Current = run
+		streak.CurrentStart = runStart.Format("2006-01-02")
+	}
+	return streak
+}
+
+// GetStreaks() returns the user's streaks up to and including today, which is
+// the user's current local date. A day only counts towards a metric when a
+// goal above zero was in effect for it and the day's total reached the goal
+func (m GoalModel) GetStreaks(userID int64, today time.Time) (*Streaks, error) {
+	query := `
+		SELECT local_date::text,
+			COALESCE(goal.goal_steps > 0 AND steps >= goal.goal_steps, false),
+			COALESCE(goal.goal_cups > 0 AND cups >= goal.goal_cups, false)
+		FROM dailyfitness` + fitnessGoalJoin + `
+		WHERE user_id = $1 AND local_date <= $2
+		ORDER BY local_date
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, today.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stepsDays, cupsDays []time.Time
+	for rows.Next() {
+		var date string
+		var stepsMet, cupsMet bool
+		err := rows.Scan(&date, &stepsMet, &cupsMet)
+		if err != nil {
+			return nil, err
+		}
+		day, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return nil, err
+		}
+		if stepsMet {
+			stepsDays = append(stepsDays, day)
+		}
+		if cupsMet {
+			cupsDays = append(cupsDays, day)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Streaks{
+		Steps: CalculateStreak(stepsDays, today),
+		Cups:  CalculateStreak(cupsDays, today),
+	}, nil
+}
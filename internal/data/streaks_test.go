@@ -0,0 +1,160 @@
+package data
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestCalculateStreak(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Days are built the way GetStreaks() reads local_date, as midnight UTC
+	date := func(value string) time.Time {
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return day
+	}
+	dates := func(values ...string) []time.Time {
+		days := []time.Time{}
+		for _, value := range values {
+			days = append(days, date(value))
+		}
+		return days
+	}
+	instant := func(value string) time.Time {
+		now, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+
+	// Today is either given, or worked out from an instant in a time zone the
+	// way the handlers do it
+	tests := []struct {
+		name     string
+		days     []time.Time
+		today    string
+		now      time.Time
+		location *time.Location
+		want     Streak
+	}{
+		{
+			name:  "no records",
+			days:  nil,
+			today: "2026-10-17",
+			want:  Streak{},
+		},
+		{
+			name:  "met today only",
+			days:  dates("2026-10-17"),
+			today: "2026-10-17",
+			want:  Streak{Current: 1, CurrentStart: "2026-10-17", Longest: 1, LongestStart: "2026-10-17"},
+		},
+		{
+			name:  "today not over yet",
+			days:  dates("2026-10-15", "2026-10-16"),
+			today: "2026-10-17",
+			want:  Streak{Current: 2, CurrentStart: "2026-10-15", Longest: 2, LongestStart: "2026-10-15"},
+		},
+		{
+			name:  "missed yesterday",
+			days:  dates("2026-10-14", "2026-10-15"),
+			today: "2026-10-17",
+			want:  Streak{Longest: 2, LongestStart: "2026-10-14"},
+		},
+		{
+			name:  "gap splits the streak",
+			days:  dates("2026-10-10", "2026-10-11", "2026-10-12", "2026-10-14", "2026-10-15", "2026-10-16", "2026-10-17"),
+			today: "2026-10-17",
+			want:  Streak{Current: 4, CurrentStart: "2026-10-14", Longest: 4, LongestStart: "2026-10-14"},
+		},
+		{
+			name:  "longest streak in the past",
+			days:  dates("2026-09-01", "2026-09-02", "2026-09-03", "2026-10-16", "2026-10-17"),
+			today: "2026-10-17",
+			want:  Streak{Current: 2, CurrentStart: "2026-10-16", Longest: 3, LongestStart: "2026-09-01"},
+		},
+		{
+			name:  "first of equal runs is the longest",
+			days:  dates("2026-10-01", "2026-10-02", "2026-10-05", "2026-10-06"),
+			today: "2026-10-17",
+			want:  Streak{Longest: 2, LongestStart: "2026-10-01"},
+		},
+		{
+			name:  "across a month boundary",
+			days:  dates("2026-09-29", "2026-09-30", "2026-10-01"),
+			today: "2026-10-01",
+			want:  Streak{Current: 3, CurrentStart: "2026-09-29", Longest: 3, LongestStart: "2026-09-29"},
+		},
+		{
+			name:  "across a leap day",
+			days:  dates("2024-02-28", "2024-02-29", "2024-03-01"),
+			today: "2024-03-02",
+			want:  Streak{Current: 3, CurrentStart: "2024-02-28", Longest: 3, LongestStart: "2024-02-28"},
+		},
+		{
+			name:  "across a year boundary",
+			days:  dates("2025-12-31", "2026-01-01"),
+			today: "2026-01-01",
+			want:  Streak{Current: 2, CurrentStart: "2025-12-31", Longest: 2, LongestStart: "2025-12-31"},
+		},
+		{
+			// New York springs forward on 2026-03-08, so 03:30 UTC the next
+			// morning is still 23:30 on the 8th there, and the 7th is yesterday
+			name:     "late evening after the start of daylight saving time",
+			days:     dates("2026-03-05", "2026-03-06", "2026-03-07"),
+			now:      instant("2026-03-09T03:30:00Z"),
+			location: newYork,
+			want:     Streak{Current: 3, CurrentStart: "2026-03-05", Longest: 3, LongestStart: "2026-03-05"},
+		},
+		{
+			// and falls back on 2026-11-01, after which it is five hours
+			// behind UTC rather than four
+			name:     "late evening after the end of daylight saving time",
+			days:     dates("2026-10-29", "2026-10-30", "2026-10-31"),
+			now:      instant("2026-11-02T04:30:00Z"),
+			location: newYork,
+			want:     Streak{Current: 3, CurrentStart: "2026-10-29", Longest: 3, LongestStart: "2026-10-29"},
+		},
+		{
+			name:     "just after midnight after the end of daylight saving time",
+			days:     dates("2026-10-29", "2026-10-30", "2026-10-31"),
+			now:      instant("2026-11-02T05:30:00Z"),
+			location: newYork,
+			want:     Streak{Current: 0, Longest: 3, LongestStart: "2026-10-29"},
+		},
+		{
+			name:  "future days are ignored",
+			days:  dates("2026-10-17", "2026-10-18", "2026-10-19"),
+			today: "2026-10-17",
+			want:  Streak{Current: 1, CurrentStart: "2026-10-17", Longest: 1, LongestStart: "2026-10-17"},
+		},
+		{
+			name:  "unsorted and repeated days",
+			days:  dates("2026-10-17", "2026-10-15", "2026-10-16", "2026-10-16"),
+			today: "2026-10-17",
+			want:  Streak{Current: 3, CurrentStart: "2026-10-15", Longest: 3, LongestStart: "2026-10-15"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var today time.Time
+			if tt.location != nil {
+				today = LocalDate(tt.now, tt.location)
+			} else {
+				today = date(tt.today)
+			}
+			got := CalculateStreak(tt.days, today)
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"fitness.zioncastillo.net/internal/validator"
@@ -17,6 +18,14 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeEmailChange    = "email-change"
+	ScopeTOTPChallenge  = "totp-challenge"
+)
+
+var (
+	ErrTokenReused = errors.New("refresh token reused")
 )
 
 // Define the Token type
@@ -26,6 +35,19 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	Family    string    `json:"-"`
+	Email     string    `json:"-"`
+}
+
+// A Session describes an authentication token without revealing it
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 // The generateToken() function returns a Token
@@ -59,30 +81,159 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the Token model
 type TokenModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Denylist *TokenDenylist
 }
 
 // Create and insert a Token into the tokens table
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewSession(userID, ttl, scope, "")
+}
+
+// NewSession() works like New() and also records the user agent of the client
+// that the token was issued to
+func (m TokenModel) NewSession(userID int64, ttl time.Duration, scope string, userAgent string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
+	token.UserAgent = userAgent
 	err = m.Insert(token)
 	return token, err
 }
 
+// NewRefresh() issues a refresh token in the given family. An empty family
+// starts a new one, as happens on login
+func (m TokenModel) NewRefresh(userID int64, ttl time.Duration, userAgent string, family string) (*Token, error) {
+	if family == "" {
+		// A family id is just another random token
+		familyToken, err := generateToken(userID, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		family = familyToken.Plaintext
+	}
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.UserAgent = userAgent
+	token.Family = family
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewEmailChange() issues a token that moves the user to the given email
+// address once it is confirmed
+func (m TokenModel) NewEmailChange(userID int64, ttl time.Duration, email string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.Email = email
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewPair() issues an authentication token and a refresh token that belong to
+// the same family. An empty family starts a new one
+func (m TokenModel) NewPair(userID int64, accessTTL time.Duration, refreshTTL time.Duration, userAgent string, family string) (*Token, *Token, error) {
+	refreshToken, err := m.NewRefresh(userID, refreshTTL, userAgent, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	token.UserAgent = userAgent
+	token.Family = refreshToken.Family
+	err = m.Insert(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, refreshToken, nil
+}
+
+// ConsumeRefresh() uses up a refresh token and returns its owner and family.
+// A used refresh token is kept until it expires so that a replay can be
+// spotted: presenting it again revokes the whole family and returns
+// ErrTokenReused
+func (m TokenModel) ConsumeRefresh(tokenPlaintext string) (int64, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	    UPDATE tokens
+		SET used_at = NOW()
+		WHERE hash = $1 AND scope = $2 AND expiry > NOW() AND used_at IS NULL
+		RETURNING user_id, family
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int64
+	var family string
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family)
+	if err == nil {
+		return userID, family, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", err
+	}
+
+	// Find out whether the token was already used
+	query = `
+	    SELECT family
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL
+	`
+	err = m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, "", ErrRecordNotFound
+		default:
+			return 0, "", err
+		}
+	}
+	err = m.DeleteFamily(family)
+	if err != nil {
+		return 0, "", err
+	}
+	return 0, "", ErrTokenReused
+}
+
+// DeleteFamily() revokes every token in a family, including the JWTs issued
+// with it
+func (m TokenModel) DeleteFamily(family string) error {
+	if family == "" {
+		return nil
+	}
+	m.Denylist.RevokeFamily(family)
+	query := `
+	    DELETE FROM tokens
+		WHERE family = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, family)
+
+	return err
+}
+
 // Insert will insert a entry into the tokes table
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-	    INSERT INTO tokens (hash, user_id, expiry,  scope)
-		VALUES ($1, $2, $3, $4)
+	    INSERT INTO tokens (hash, user_id, expiry,  scope, user_agent, family, email)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
 	`
 	args := []interface{}{
 		token.Hash,
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.UserAgent,
+		token.Family,
+		token.Email,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -90,7 +241,12 @@ func (m TokenModel) Insert(token *Token) error {
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
+// DeleteAllForUsers() removes a user's tokens of one scope. Removing the
+// refresh tokens logs the user out everywhere, so their JWTs are denied too
 func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
+	if scope == ScopeRefresh {
+		m.Denylist.RevokeUser(userID)
+	}
 	query := `
 	    DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2
@@ -100,4 +256,93 @@ func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 
 	return err
-}
\ No newline at end of file
+}
+
+// Revoke() removes the token with the given scope and plaintext, along with
+// the rest of its family so that its refresh token stops working too
+func (m TokenModel) Revoke(scope string, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	    DELETE FROM tokens
+		WHERE (hash = $1 AND scope = $2)
+		OR family = (
+			SELECT family FROM tokens
+			WHERE hash = $1 AND scope = $2 AND family <> ''
+		)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+
+	return err
+}
+
+// TouchInterval is how often at most the last_used_at time of a token or an
+// API key is written. Callers check NeedsTouch() before calling Touch() so
+// that most requests cost no write at all
+const TouchInterval = time.Minute
+
+// NeedsTouch() reports whether a last_used_at time is old enough, or missing,
+// for Touch() to update it
+func NeedsTouch(lastUsedAt *time.Time, now time.Time) bool {
+	return lastUsedAt == nil || now.Sub(*lastUsedAt) >= TouchInterval
+}
+
+// Touch() records that a token was just used. To save writes the time is only
+// updated once a minute, even when requests race past NeedsTouch()
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	    UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - interval '1 minute')
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+
+	return err
+}
+
+// GetSessionsForUser() lists the unexpired, unused tokens of a user with the
+// given scope, the newest first. The token matching currentPlaintext, or any
+// token in currentFamily, is marked as current
+func (m TokenModel) GetSessionsForUser(userID int64, scope string, currentPlaintext string, currentFamily string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+	    SELECT id, created_at, expiry, last_used_at, user_agent,
+			hash = $3 OR (family <> '' AND family = $4)
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > NOW() AND used_at IS NULL
+		ORDER BY created_at DESC, id DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, scope, currentHash[:], currentFamily)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.LastUsedAt,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
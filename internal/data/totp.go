@@ -0,0 +1,279 @@
+// Filename: internal/data/totp.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"fitness.zioncastillo.net/internal/totp"
+	"fitness.zioncastillo.net/internal/validator"
+)
+
+// The number of recovery codes handed out when 2FA is enabled
+const RecoveryCodeCount = 10
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+)
+
+// TOTP holds a user's two-factor secret. LastCounter is the time step of the
+// last accepted code, so a code cannot be used twice
+type TOTP struct {
+	UserID      int64
+	Secret      []byte
+	Confirmed   bool
+	LastCounter int64
+}
+
+// ValidateTOTPCode checks that a code looks like one from an authenticator app
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == totp.Digits, "code", "must be 6 digits long")
+}
+
+// The generateRecoveryCode() function returns a code such as "ABCDE-FGHJK"
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 10)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// The hashRecoveryCode() function hashes a code after normalising how it was typed
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// Define the TOTP model
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the two-factor secret of a user
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, secret, confirmed, last_counter
+		FROM totp
+		WHERE user_id = $1
+	`
+	var t TOTP
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.Confirmed, &t.LastCounter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// IsEnabled() reports whether a user has confirmed two-factor authentication
+func (m TOTPModel) IsEnabled(userID int64) (bool, error) {
+	t, err := m.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return t.Confirmed, nil
+}
+
+// Enroll() stores a new unconfirmed secret for a user, replacing any earlier
+// unconfirmed one. A confirmed secret is never replaced
+func (m TOTPModel) Enroll(userID int64, secret []byte) error {
+	query := `
+		INSERT INTO totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_counter = 0, created_at = NOW()
+		WHERE totp.confirmed = false
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+// UseCounter() records that the code for counter was accepted. It returns
+// ErrRecordNotFound if a code from that time step or a later one was already
+// used
+func (m TOTPModel) UseCounter(userID int64, counter int64) error {
+	query := `
+		UPDATE totp
+		SET last_counter = $2
+		WHERE user_id = $1 AND last_counter < $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Delete() turns two-factor authentication off for a user
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Confirm() turns on the unconfirmed secret of a user once the code for
+// counter was accepted, and hands out their first recovery codes. Both happen
+// in one transaction, so two-factor authentication is never on without
+// recovery codes. It returns ErrRecordNotFound if the secret was confirmed
+// already or a code from that time step or a later one was used
+func (m TOTPModel) Confirm(userID int64, counter int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE totp
+		SET last_counter = $2, confirmed = true
+		WHERE user_id = $1 AND confirmed = false AND last_counter < $2
+	`, userID, counter)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrRecordNotFound
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// NewRecoveryCodes() replaces the recovery codes of a user with new ones. Only
+// their hashes are stored, so the plaintext codes are returned just this once
+func (m TOTPModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// replaceRecoveryCodes() swaps the recovery codes of a user for new ones
+// within tx and returns the plaintext codes
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		codes[i], err = generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO recovery_codes (user_id, hash)
+			VALUES ($1, $2)
+		`, userID, hashRecoveryCode(codes[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode() uses up one of a user's recovery codes. It returns
+// ErrRecordNotFound if the code is unknown or was already used
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) error {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
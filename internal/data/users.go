@@ -17,6 +17,13 @@ var (
 // Declare an AnonymousUser, no id, no name, no email, no password
 var AnonymousUser = &User{}
 
+// A password hash that belongs to no account, made from random bytes that were
+// thrown away. Checking against it takes as long as checking a real password
+var noAccountPassword = password{hash: []byte("$2a$12$nyOGdQ9YMxClZB49cJnAmewxlZO0.JvjzqC68CJ9BxPycqzcLhUE.")}
+
+// Units a user can prefer for display. Measurements are always stored metric
+var UnitSystems = []string{"metric", "imperial"}
+
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -24,7 +31,35 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	HeightCM  *float64  `json:"height_cm"`
+	WeightKG  *float64  `json:"weight_kg"`
+	BirthDate *string   `json:"birth_date"`
+	TimeZone  string    `json:"time_zone"`
+	Units     string    `json:"units"`
+	Version   int       `json:"version"`
+}
+
+// The columns scanned by scanDest(), in the same order
+const userColumns = `users.id, users.created_at, users.name, users.email, users.password_hash,
+		users.activated, users.height_cm, users.weight_kg, users.birth_date::text,
+		users.time_zone, users.units, users.version`
+
+// The scanDest() method returns the destinations for a row of userColumns
+func (u *User) scanDest() []interface{} {
+	return []interface{}{
+		&u.ID,
+		&u.CreatedAt,
+		&u.Name,
+		&u.Email,
+		&u.Password.hash,
+		&u.Activated,
+		&u.HeightCM,
+		&u.WeightKG,
+		&u.BirthDate,
+		&u.TimeZone,
+		&u.Units,
+		&u.Version,
+	}
 }
 
 // Check if a user is anonymous
@@ -60,6 +95,13 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	}
 	return true, nil
 }
+// NoAccountPasswordMatches() checks a password sent with an email address that
+// has no account. It never matches, but takes as long as a real check so that
+// the response time does not give the unknown address away
+func NoAccountPasswordMatches(plaintextPassword string) (bool, error) {
+	_, err := noAccountPassword.Matches(plaintextPassword)
+	return false, err
+}
 // Validate the client request
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
@@ -84,6 +126,29 @@ func ValidateUser(v *validator.Validator, user *User) {
 		panic("missing password hash for the user")
 	}
 }
+
+// ValidateProfile checks the optional profile fields of a user
+func ValidateProfile(v *validator.Validator, user *User) {
+	if user.HeightCM != nil {
+		v.Check(*user.HeightCM >= 30 && *user.HeightCM <= 300, "height_cm", "must be between 30 and 300")
+	}
+	if user.WeightKG != nil {
+		v.Check(*user.WeightKG >= 2 && *user.WeightKG <= 700, "weight_kg", "must be between 2 and 700")
+	}
+	if user.BirthDate != nil {
+		date, err := time.Parse("2006-01-02", *user.BirthDate)
+		if err != nil {
+			v.AddError("birth_date", "must be a date in the format YYYY-MM-DD")
+		} else {
+			v.Check(date.Year() >= 1900, "birth_date", "must not be before 1900")
+			v.Check(date.Before(time.Now()), "birth_date", "must be in the past")
+		}
+	}
+	_, err := time.LoadLocation(user.TimeZone)
+	v.Check(user.TimeZone != "" && user.TimeZone != "Local" && err == nil, "time_zone", "must be a valid time zone")
+	v.Check(validator.In(user.Units, UnitSystems...), "units", "must be metric or imperial")
+}
+
 // Create our user model
 type UserModel struct {
 	DB *sql.DB
@@ -94,7 +159,7 @@ func (m UserModel) Insert(user *User) error {
 	query := `
 	    INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version
+		RETURNING id, created_at, time_zone, units, version
 	`
 	args := []interface{}{
 		user.Name,
@@ -104,7 +169,7 @@ func (m UserModel) Insert(user *User) error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.TimeZone, &user.Units, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -115,25 +180,41 @@ func (m UserModel) Insert(user *User) error {
 	}
 	return nil
 }
+// Get user based on their id
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+	    SELECT ` + userColumns + `
+		FROM users
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(user.scanDest()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
 // Get user based on their email
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-	    SELECT id, created_at, name, email, password_hash, activated, version
+	    SELECT ` + userColumns + `
 		FROM users
-		WHERE email = $1
+		WHERE email = $1 AND deleted_at IS NULL
 	`
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(user.scanDest()...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -148,8 +229,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
 	    UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4,
+		    height_cm = $5, weight_kg = $6, birth_date = $7, time_zone = $8, units = $9,
+		    version = version + 1
+		WHERE id = $10 AND version = $11
 		RETURNING version
 	`
 	args := []interface{}{
@@ -157,6 +240,11 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.HeightCM,
+		user.WeightKG,
+		user.BirthDate,
+		user.TimeZone,
+		user.Units,
 		user.ID,
 		user.Version,
 	}
@@ -167,6 +255,8 @@ func (m UserModel) Update(user *User) error {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
 		default:
 			return err
 		}
@@ -179,28 +269,21 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Setup query
 	query := `
-	    SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	    SELECT ` + userColumns + `
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
 		WHERE tokens.hash = $1
 		AND tokens.scope = $2
 		AND tokens.expiry > $3
+		AND users.deleted_at IS NULL
 	`
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(user.scanDest()...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -210,4 +293,157 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 	return &user, nil
-}
\ No newline at end of file
+}
+
+// GetForSessionToken() returns the user an unexpired authentication token
+// belongs to, along with when the token was last used
+func (m UserModel) GetForSessionToken(tokenPlaintext string) (*User, *time.Time, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	    SELECT ` + userColumns + `, tokens.last_used_at
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND users.deleted_at IS NULL
+	`
+	args := []interface{}{tokenHash[:], ScopeAuthentication, time.Now()}
+	var user User
+	var lastUsedAt *time.Time
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(append(user.scanDest(), &lastUsedAt)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &user, lastUsedAt, nil
+}
+
+// GetForEmailChangeToken() returns the user an unexpired email-change token
+// belongs to, along with the address the token was issued for
+func (m UserModel) GetForEmailChangeToken(tokenPlaintext string) (*User, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	    SELECT ` + userColumns + `, tokens.email
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND users.deleted_at IS NULL
+	`
+	args := []interface{}{tokenHash[:], ScopeEmailChange, time.Now()}
+	var user User
+	var email string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(append(user.scanDest(), &email)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", ErrRecordNotFound
+		default:
+			return nil, "", err
+		}
+	}
+	return &user, email, nil
+}
+
+// SoftDelete() marks a user as deleted. The account stops working straight
+// away but is only purged once the grace period is over
+func (m UserModel) SoftDelete(user *User) error {
+	query := `
+	    UPDATE users
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDeletedByEmail() returns a user that was deleted after since and so
+// can still be restored
+func (m UserModel) GetDeletedByEmail(email string, since time.Time) (*User, error) {
+	query := `
+	    SELECT ` + userColumns + `
+		FROM users
+		WHERE email = $1 AND deleted_at > $2
+	`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, email, since).Scan(user.scanDest()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// Restore() undoes SoftDelete()
+func (m UserModel) Restore(user *User) error {
+	query := `
+	    UPDATE users
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NOT NULL
+		RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge() permanently removes the users deleted before the given time. Their
+// tokens, permissions, roles, API keys, goals, fitness records and increments
+// go with them through ON DELETE CASCADE
+func (m UserModel) Purge(before time.Time) (int, error) {
+	query := `
+	    DELETE FROM users
+		WHERE deleted_at < $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
@@ -0,0 +1,234 @@
+// Filename: internal/jwt/jwt.go
+
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Signing algorithms supported by a Key
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+)
+
+// Claims are the values carried inside an access token
+type Claims struct {
+	Subject     string   `json:"sub"`
+	Activated   bool     `json:"act"`
+	TimeZone    string   `json:"tz,omitempty"`
+	Permissions []string `json:"perms"`
+	Family      string   `json:"fam,omitempty"`
+	IssuedAt    int64    `json:"iat"`
+	Expiry      int64    `json:"exp"`
+}
+
+// The header of a token names the algorithm and the key that signed it
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// A Key signs and verifies tokens. An Ed25519 key loaded from a public key
+// file can only verify
+type Key struct {
+	ID         string
+	Alg        string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// A KeySet holds every key that tokens may be verified with, looked up by the
+// kid in the token header. Rotating keys means adding a new key, making it the
+// signing key, and removing the old one once its tokens have expired
+type KeySet struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// LoadKeys() reads the keys in a directory. The file name without its
+// extension is the kid: "<kid>.hmac" holds an HMAC secret of at least 32
+// bytes, "<kid>.pem" holds a PKCS #8 Ed25519 private key or a PKIX Ed25519
+// public key. Tokens are signed with the key named by signingKID
+func LoadKeys(dir string, signingKID string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ks := &KeySet{keys: make(map[string]*Key)}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if ext != ".hmac" && ext != ".pem" {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(strings.TrimSuffix(entry.Name(), ext), ext, contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	signing, found := ks.keys[signingKID]
+	if !found {
+		return nil, fmt.Errorf("signing key %q not found in %s", signingKID, dir)
+	}
+	if signing.Alg == AlgEdDSA && signing.privateKey == nil {
+		return nil, fmt.Errorf("signing key %q is a public key", signingKID)
+	}
+	ks.signing = signing
+	return ks, nil
+}
+
+// The parseKey() function builds a Key from the contents of a key file
+func parseKey(id string, ext string, contents []byte) (*Key, error) {
+	if ext == ".hmac" {
+		secret := bytes.TrimSpace(contents)
+		if len(secret) < 32 {
+			return nil, errors.New("hmac secret must be at least 32 bytes long")
+		}
+		return &Key{ID: id, Alg: AlgHS256, secret: secret}, nil
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an Ed25519 key")
+		}
+		return &Key{ID: id, Alg: AlgEdDSA, privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}, nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not an Ed25519 key")
+		}
+		return &Key{ID: id, Alg: AlgEdDSA, publicKey: publicKey}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// sign() returns the signature of the signing input
+func (k *Key) sign(input []byte) []byte {
+	if k.Alg == AlgHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.privateKey, input)
+}
+
+// verify() checks the signature of the signing input
+func (k *Key) verify(input []byte, signature []byte) bool {
+	if k.Alg == AlgHS256 {
+		return hmac.Equal(signature, k.sign(input))
+	}
+	return ed25519.Verify(k.publicKey, input, signature)
+}
+
+// Sign() encodes the claims as a compact JWT signed with the signing key
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	headerJSON, err := json.Marshal(header{Alg: ks.signing.Alg, Typ: "JWT", Kid: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	signature := ks.signing.sign([]byte(input))
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify() checks the signature and expiry of a token and returns its claims.
+// The algorithm in the header has to match the key named by its kid, so a
+// token cannot pick a weaker way to be checked
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	err = json.Unmarshal(headerJSON, &h)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, found := ks.keys[h.Kid]
+	if !found || key.Alg != h.Alg {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// IsJWT() reports whether a bearer token has the shape of a JWT rather than
+// an opaque token
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
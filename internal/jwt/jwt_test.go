@@ -0,0 +1,229 @@
+// Filename: internal/jwt/jwt_test.go
+
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeys() writes key files into a new directory and returns its path
+func writeKeys(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		err := os.WriteFile(filepath.Join(dir, name), contents, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// newEd25519PEM() returns a new Ed25519 key pair as PKCS #8 and PKIX PEM files
+func newEd25519PEM(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+}
+
+// replacePart() swaps one dot-separated part of a token for the encoding of v
+func replacePart(t *testing.T, token string, index int, v interface{}) string {
+	t.Helper()
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	parts[index] = base64.RawURLEncoding.EncodeToString(js)
+	return strings.Join(parts, ".")
+}
+
+func TestSignVerify(t *testing.T) {
+	privatePEM, _ := newEd25519PEM(t)
+	files := map[string][]byte{
+		"hs.hmac": []byte(strings.Repeat("s", 32)),
+		"ed.pem":  privatePEM,
+	}
+
+	now := time.Unix(1_800_000_000, 0)
+	claims := Claims{
+		Subject:     "42",
+		Activated:   true,
+		Permissions: []string{"dailyfitness:read", "dailyfitness:write"},
+		Family:      "family",
+		IssuedAt:    now.Unix(),
+		Expiry:      now.Add(15 * time.Minute).Unix(),
+	}
+
+	tests := []struct {
+		name string
+		kid  string
+		alg  string
+	}{
+		{name: "HS256", kid: "hs", alg: AlgHS256},
+		{name: "EdDSA", kid: "ed", alg: AlgEdDSA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks, err := LoadKeys(writeKeys(t, files), tt.kid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := ks.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsJWT(token) {
+				t.Fatalf("IsJWT(%q) = false", token)
+			}
+
+			var h header
+			headerJSON, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+			if err := json.Unmarshal(headerJSON, &h); err != nil {
+				t.Fatal(err)
+			}
+			if h.Alg != tt.alg || h.Kid != tt.kid {
+				t.Errorf("header = %+v; want alg %s and kid %s", h, tt.alg, tt.kid)
+			}
+
+			got, err := ks.Verify(token, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Subject != claims.Subject || got.Family != claims.Family || got.Expiry != claims.Expiry ||
+				strings.Join(got.Permissions, ",") != strings.Join(claims.Permissions, ",") {
+				t.Errorf("got %+v; want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	privatePEM, publicPEM := newEd25519PEM(t)
+	otherPEM, _ := newEd25519PEM(t)
+	hmacSecret := []byte(strings.Repeat("s", 32))
+
+	signer, err := LoadKeys(writeKeys(t, map[string][]byte{
+		"hs.hmac": hmacSecret,
+		"ed.pem":  privatePEM,
+	}), "ed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The verifier only holds the public half of the Ed25519 key
+	verifier, err := LoadKeys(writeKeys(t, map[string][]byte{
+		"hs.hmac": hmacSecret,
+		"ed.pem":  publicPEM,
+	}), "hs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A different key that claims the same kid
+	impostor, err := LoadKeys(writeKeys(t, map[string][]byte{"ed.pem": otherPEM}), "ed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_800_000_000, 0)
+	claims := Claims{Subject: "42", IssuedAt: now.Unix(), Expiry: now.Add(time.Minute).Unix()}
+	sign := func(ks *KeySet, claims Claims) string {
+		token, err := ks.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	token := sign(signer, claims)
+
+	// An HS256 token keyed with the Ed25519 public key that names the
+	// Ed25519 kid, the classic algorithm confusion attack
+	confused := replacePart(t, token, 0, header{Alg: AlgHS256, Typ: "JWT", Kid: "ed"})
+	confusedKey := &Key{ID: "ed", Alg: AlgHS256, secret: publicPEM}
+	input := strings.Join(strings.Split(confused, ".")[:2], ".")
+	confused = input + "." + base64.RawURLEncoding.EncodeToString(confusedKey.sign([]byte(input)))
+
+	tampered := claims
+	tampered.Subject = "1"
+
+	tests := []struct {
+		name    string
+		token   string
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid with a public-only key", token: token, now: now},
+		{name: "one second before expiry", token: token, now: time.Unix(claims.Expiry-1, 0)},
+		{name: "at expiry", token: token, now: time.Unix(claims.Expiry, 0), wantErr: ErrExpiredToken},
+		{name: "after expiry", token: token, now: time.Unix(claims.Expiry+1, 0), wantErr: ErrExpiredToken},
+		{name: "alg does not match the kid", token: confused, now: now, wantErr: ErrInvalidToken},
+		{name: "kid of another algorithm", token: replacePart(t, token, 0, header{Alg: AlgEdDSA, Typ: "JWT", Kid: "hs"}), now: now, wantErr: ErrInvalidToken},
+		{name: "unknown kid", token: replacePart(t, token, 0, header{Alg: AlgEdDSA, Typ: "JWT", Kid: "missing"}), now: now, wantErr: ErrInvalidToken},
+		{name: "signed by another key with the same kid", token: sign(impostor, claims), now: now, wantErr: ErrInvalidToken},
+		{name: "tampered payload", token: replacePart(t, token, 1, tampered), now: now, wantErr: ErrInvalidToken},
+		{name: "missing signature", token: strings.Join(strings.Split(token, ".")[:2], ".") + ".", now: now, wantErr: ErrInvalidToken},
+		{name: "not a JWT", token: "abc", now: now, wantErr: ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifier.Verify(tt.token, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got.Subject != claims.Subject {
+				t.Errorf("got subject %q; want %q", got.Subject, claims.Subject)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	privatePEM, publicPEM := newEd25519PEM(t)
+
+	tests := []struct {
+		name       string
+		files      map[string][]byte
+		signingKID string
+		wantErr    bool
+	}{
+		{name: "hmac signing key", files: map[string][]byte{"hs.hmac": []byte(strings.Repeat("s", 32))}, signingKID: "hs"},
+		{name: "private signing key", files: map[string][]byte{"ed.pem": privatePEM}, signingKID: "ed"},
+		{name: "public-only signing key", files: map[string][]byte{"ed.pem": publicPEM}, signingKID: "ed", wantErr: true},
+		{name: "short hmac secret", files: map[string][]byte{"hs.hmac": []byte("short")}, signingKID: "hs", wantErr: true},
+		{name: "missing signing key", files: map[string][]byte{"hs.hmac": []byte(strings.Repeat("s", 32))}, signingKID: "other", wantErr: true},
+		{name: "not PEM", files: map[string][]byte{"ed.pem": []byte("not a key")}, signingKID: "ed", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeys(writeKeys(t, tt.files), tt.signingKID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
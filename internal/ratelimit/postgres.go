@@ -0,0 +1,56 @@
+// Filename: internal/ratelimit/postgres.go
+
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps the buckets in the rate_limits table, so that every
+// API instance sees the same limits
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+// Allow() takes a token from the bucket with the given key. The bucket is
+// created, refilled and drawn from in a single statement, which Postgres runs
+// with the row locked, so concurrent requests are counted once each
+func (s PostgresStore) Allow(ctx context.Context, key string, policy Policy, now time.Time) (Result, error) {
+	// The tokens in the bucket once it is refilled for the time since its
+	// last update, as take() works them out
+	refilled := `LEAST($2::double precision, rate_limits.tokens +
+		GREATEST(EXTRACT(EPOCH FROM $4::timestamptz - rate_limits.updated_at), 0) * $3::double precision)`
+	query := `
+		INSERT INTO rate_limits (key, tokens, updated_at, allowed)
+		VALUES ($1, GREATEST($2::double precision - 1, 0), $4::timestamptz, $2::double precision >= 1)
+		ON CONFLICT (key) DO UPDATE
+		SET tokens = ` + refilled + ` - CASE WHEN ` + refilled + ` >= 1 THEN 1 ELSE 0 END,
+			allowed = ` + refilled + ` >= 1,
+			updated_at = $4::timestamptz
+		RETURNING tokens, allowed
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var tokens float64
+	var allowed bool
+	err := s.DB.QueryRowContext(ctx, query, key, policy.Burst, policy.Rate, now).Scan(&tokens, &allowed)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(tokens, policy, allowed), nil
+}
+
+// Sweep() drops the buckets that have not been used since before
+func (s PostgresStore) Sweep(ctx context.Context, before time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `
+		DELETE FROM rate_limits
+		WHERE updated_at < $1
+	`, before)
+	return err
+}
@@ -0,0 +1,80 @@
+// Filename: internal/ratelimit/ratelimit.go
+
+// Package ratelimit implements token bucket rate limiting over a pluggable
+// Store, so that several API instances can share their buckets
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// A Policy allows Rate requests per second on average, with bursts of up to
+// Burst requests
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+// A Result describes the state of a bucket after a request was counted
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until the next request is allowed, when not allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// A Store keeps the buckets. Allow() takes a token from the bucket with the
+// given key, creating a full one if needed. Sweep() drops the buckets that
+// have not been used since before
+type Store interface {
+	Allow(ctx context.Context, key string, policy Policy, now time.Time) (Result, error)
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// A bucket holds the tokens left at the time it was last updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// The take() function refills b for the time since it was last updated and
+// takes a token from it if one is left. The memory store uses it directly
+// and the Postgres store does the same sums in SQL
+func take(b *bucket, policy Policy, now time.Time) Result {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(policy.Burst), b.tokens+elapsed*policy.Rate)
+	}
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return newResult(b.tokens, policy, allowed)
+}
+
+// The newResult() function describes a bucket left with tokens after a
+// request was counted against it
+func newResult(tokens float64, policy Policy, allowed bool) Result {
+	result := Result{Allowed: allowed, Limit: policy.Burst, Remaining: int(tokens)}
+	if !allowed {
+		if policy.Rate > 0 {
+			result.RetryAfter = seconds((1 - tokens) / policy.Rate)
+		} else {
+			result.RetryAfter = time.Duration(math.MaxInt64)
+		}
+	}
+	if policy.Rate > 0 {
+		result.Reset = seconds((float64(policy.Burst) - tokens) / policy.Rate)
+	}
+	return result
+}
+
+// The seconds() function converts a number of seconds to a Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,129 @@
+// Filename: internal/ratelimit/ratelimit_test.go
+
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	policy := Policy{Rate: 2, Burst: 4}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		bucket     bucket
+		policy     Policy
+		want       Result
+		wantTokens float64
+	}{
+		{
+			name:       "full bucket",
+			bucket:     bucket{tokens: 4, updated: now},
+			policy:     policy,
+			want:       Result{Allowed: true, Limit: 4, Remaining: 3, Reset: 500 * time.Millisecond},
+			wantTokens: 3,
+		},
+		{
+			name:       "last token",
+			bucket:     bucket{tokens: 1, updated: now},
+			policy:     policy,
+			want:       Result{Allowed: true, Limit: 4, Remaining: 0, Reset: 2 * time.Second},
+			wantTokens: 0,
+		},
+		{
+			name:       "empty bucket waits for the next token",
+			bucket:     bucket{tokens: 0, updated: now},
+			policy:     policy,
+			want:       Result{Allowed: false, Limit: 4, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 2 * time.Second},
+			wantTokens: 0,
+		},
+		{
+			name:       "part of a token left",
+			bucket:     bucket{tokens: 0.5, updated: now},
+			policy:     policy,
+			want:       Result{Allowed: false, Limit: 4, Remaining: 0, RetryAfter: 250 * time.Millisecond, Reset: 1750 * time.Millisecond},
+			wantTokens: 0.5,
+		},
+		{
+			name:       "refilled for the time since the last update",
+			bucket:     bucket{tokens: 0, updated: now.Add(-time.Second)},
+			policy:     policy,
+			want:       Result{Allowed: true, Limit: 4, Remaining: 1, Reset: 1500 * time.Millisecond},
+			wantTokens: 1,
+		},
+		{
+			name:       "refill stops at the burst",
+			bucket:     bucket{tokens: 0, updated: now.Add(-time.Hour)},
+			policy:     policy,
+			want:       Result{Allowed: true, Limit: 4, Remaining: 3, Reset: 500 * time.Millisecond},
+			wantTokens: 3,
+		},
+		{
+			name:       "clock going backwards does not drain the bucket",
+			bucket:     bucket{tokens: 2, updated: now.Add(time.Second)},
+			policy:     policy,
+			want:       Result{Allowed: true, Limit: 4, Remaining: 1, Reset: 1500 * time.Millisecond},
+			wantTokens: 1,
+		},
+		{
+			name:       "no refill rate",
+			bucket:     bucket{tokens: 0, updated: now.Add(-time.Hour)},
+			policy:     Policy{Rate: 0, Burst: 4},
+			want:       Result{Allowed: false, Limit: 4, Remaining: 0, RetryAfter: time.Duration(math.MaxInt64)},
+			wantTokens: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.bucket
+			got := take(&b, tt.policy, now)
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+			if b.tokens != tt.wantTokens {
+				t.Errorf("got %v tokens left; want %v", b.tokens, tt.wantTokens)
+			}
+			if !b.updated.Equal(now) {
+				t.Errorf("bucket updated at %v; want %v", b.updated, now)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreBurst(t *testing.T) {
+	store := NewMemoryStore()
+	policy := Policy{Rate: 1, Burst: 3}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	// A new bucket allows a burst of requests and then refuses
+	for i := 1; i <= policy.Burst+1; i++ {
+		result, err := store.Allow(context.Background(), "key", policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i <= policy.Burst; result.Allowed != want {
+			t.Fatalf("request %d: allowed = %t; want %t", i, result.Allowed, want)
+		}
+	}
+	// Other keys have buckets of their own
+	result, err := store.Allow(context.Background(), "other", policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Error("request for another key was refused")
+	}
+	// Once a token has come back one more request is allowed
+	result, err = store.Allow(context.Background(), "key", policy, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed {
+		t.Error("request after the refill was refused")
+	}
+}
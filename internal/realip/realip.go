@@ -0,0 +1,147 @@
+// Filename: internal/realip/realip.go
+
+// Package realip finds the address of the client behind a chain of proxies.
+// Forwarding headers are only believed when they were added by a proxy we
+// trust, since anyone else can put whatever they like in them
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The forwarding headers a Resolver can read
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// A Resolver knows which proxies are trusted and which forwarding header they
+// set
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// New() returns a Resolver that trusts the given CIDRs and reads the given
+// forwarding header. A bare IP address is taken as a network of its own. Only
+// the header the proxies set is read: a client can send the other one too,
+// and the proxies would pass it on untouched
+func New(cidrs []string, header string) (*Resolver, error) {
+	resolver := &Resolver{}
+	switch http.CanonicalHeaderKey(header) {
+	case HeaderXForwardedFor:
+		resolver.header = HeaderXForwardedFor
+	case HeaderForwarded:
+		resolver.header = HeaderForwarded
+	default:
+		return nil, fmt.Errorf("unsupported forwarding header %q", header)
+	}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
+
+// The isTrusted() method reports whether ip belongs to a trusted proxy
+func (res *Resolver) isTrusted(ip net.IP) bool {
+	for _, network := range res.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP() returns the address of the client that sent r. When the peer is
+// a trusted proxy, the forwarded addresses are walked from the nearest hop
+// outwards and the first one that is not a trusted proxy is the client
+func (res *Resolver) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !res.isTrusted(peer) {
+		return host
+	}
+
+	var hops []string
+	if res.header == HeaderForwarded {
+		hops = forwardedFor(r.Header)
+	} else {
+		hops = xForwardedFor(r.Header)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseAddr(hops[i])
+		// Stop at anything we cannot read, and fall back to the last hop
+		// we know a trusted proxy talked to
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !res.isTrusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// The xForwardedFor() function returns the addresses in the X-Forwarded-For
+// headers, the client first
+func xForwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// The forwardedFor() function returns the "for" parameters of the RFC 7239
+// Forwarded headers, the client first. An element without one counts as an
+// unreadable hop
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hop = strings.Trim(val, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// The parseAddr() function reads an address such as "192.0.2.1",
+// "192.0.2.1:4711", "2001:db8::1" or "[2001:db8::1]:4711". Obfuscated and
+// "unknown" identifiers give nil
+func parseAddr(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+}
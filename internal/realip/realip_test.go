@@ -0,0 +1,206 @@
+// Filename: internal/realip/realip_test.go
+
+package realip
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestXForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{name: "no header", values: nil, want: nil},
+		{name: "one address", values: []string{"192.0.2.1"}, want: []string{"192.0.2.1"}},
+		{name: "list with spaces", values: []string{"192.0.2.1, 198.51.100.2 ,10.0.0.1"}, want: []string{"192.0.2.1", "198.51.100.2", "10.0.0.1"}},
+		{name: "repeated headers", values: []string{"192.0.2.1", "198.51.100.2, 10.0.0.1"}, want: []string{"192.0.2.1", "198.51.100.2", "10.0.0.1"}},
+		{name: "empty element", values: []string{"192.0.2.1,,10.0.0.1"}, want: []string{"192.0.2.1", "", "10.0.0.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range tt.values {
+				header.Add("X-Forwarded-For", value)
+			}
+			got := xForwardedFor(header)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{name: "no header", values: nil, want: nil},
+		{name: "one element", values: []string{"for=192.0.2.1"}, want: []string{"192.0.2.1"}},
+		{name: "quoted IPv6 with port", values: []string{`for="[2001:db8::1]:4711"`}, want: []string{"[2001:db8::1]:4711"}},
+		{name: "other parameters", values: []string{"proto=https;For=192.0.2.1;by=10.0.0.1"}, want: []string{"192.0.2.1"}},
+		{name: "list of elements", values: []string{"for=192.0.2.1, for=198.51.100.2"}, want: []string{"192.0.2.1", "198.51.100.2"}},
+		{name: "repeated headers", values: []string{"for=192.0.2.1", "for=10.0.0.1"}, want: []string{"192.0.2.1", "10.0.0.1"}},
+		{name: "element without for", values: []string{"for=192.0.2.1, proto=https"}, want: []string{"192.0.2.1", ""}},
+		{name: "obfuscated identifier", values: []string{"for=_hidden"}, want: []string{"_hidden"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range tt.values {
+				header.Add("Forwarded", value)
+			}
+			got := forwardedFor(header)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "2001:db8:ffff::1"}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		xff        string
+		forwarded  string
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores the header",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "203.0.113.9:5000",
+			xff:        "192.0.2.1",
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "trusted peer without a header",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "10.0.0.1:5000",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "client behind one proxy",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "10.0.0.1:5000",
+			xff:        "192.0.2.1",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "spoofed entries before the client are skipped",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "10.0.0.1:5000",
+			xff:        "198.51.100.66, 192.0.2.1, 10.0.0.2",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "unreadable hop stops at the last trusted proxy",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "10.0.0.1:5000",
+			xff:        "192.0.2.1, garbage, 10.0.0.2",
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "every hop trusted",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "10.0.0.1:5000",
+			xff:        "10.0.0.3, 10.0.0.2",
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "IPv6 proxy given as a bare address",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "[2001:db8:ffff::1]:5000",
+			xff:        "2001:db8::7",
+			want:       "2001:db8::7",
+		},
+		{
+			name:       "X-Forwarded-For proxy ignores a client's Forwarded header",
+			header:     HeaderXForwardedFor,
+			remoteAddr: "10.0.0.1:5000",
+			xff:        "192.0.2.1",
+			forwarded:  "for=198.51.100.66",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "Forwarded proxy",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  `for="[2001:db8::7]:4711", for=10.0.0.2`,
+			want:       "2001:db8::7",
+		},
+		{
+			name:       "Forwarded proxy ignores a client's X-Forwarded-For header",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			xff:        "198.51.100.66",
+			forwarded:  "for=192.0.2.1",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "Forwarded element without for stops the walk",
+			header:     HeaderForwarded,
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  "for=192.0.2.1, proto=https",
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := New(trusted, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("Forwarded", tt.forwarded)
+			}
+			if got := resolver.ClientIP(r); got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		header  string
+		wantErr bool
+	}{
+		{name: "X-Forwarded-For", cidrs: []string{"10.0.0.0/8"}, header: HeaderXForwardedFor},
+		{name: "Forwarded", cidrs: []string{"10.0.0.1"}, header: HeaderForwarded},
+		{name: "header in lower case", cidrs: nil, header: "x-forwarded-for"},
+		{name: "unsupported header", cidrs: nil, header: "X-Real-IP", wantErr: true},
+		{name: "bad CIDR", cidrs: []string{"10.0.0.0/33"}, header: HeaderXForwardedFor, wantErr: true},
+		{name: "not an address", cidrs: []string{"proxy"}, header: HeaderXForwardedFor, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cidrs, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Filename: internal/totp/totp.go
+
+// Package totp implements time-based one-time passwords as described in
+// RFC 6238, using HMAC-SHA1 and 30 second steps as authenticator apps expect
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// Period is the number of seconds each code is valid for
+	Period = 30
+	// Digits is the length of the codes we hand out
+	Digits = 6
+	// SecretSize is the length of generated secrets in bytes, as RFC 4226 recommends
+	SecretSize = 20
+)
+
+// The encoding authenticator apps use for secrets
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret() returns a new random secret
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret() returns the base32 form of a secret that users can type in
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// Counter() returns the time step that t falls in
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// GenerateCode() returns the code with the given number of digits for a counter
+func GenerateCode(secret []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Validate() checks a code against the time steps around now, allowing skew
+// steps either way for clock drift. It returns the counter the code matched
+// so that callers can refuse to accept the same code twice
+func Validate(secret []byte, code string, now time.Time, skew int) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	counter := Counter(now)
+	for i := -skew; i <= skew; i++ {
+		expected := GenerateCode(secret, counter+int64(i), Digits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// URI() returns the otpauth:// URI that authenticator apps read from a QR code
+func URI(issuer string, account string, secret []byte) string {
+	values := url.Values{}
+	values.Set("secret", EncodeSecret(secret))
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(Digits))
+	values.Set("period", fmt.Sprint(Period))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
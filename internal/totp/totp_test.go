@@ -0,0 +1,75 @@
+// Filename: internal/totp/totp_test.go
+
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238 appendix B
+func TestGenerateCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got := GenerateCode(secret, Counter(time.Unix(tt.unix, 0)), 8)
+		if got != tt.want {
+			t.Errorf("GenerateCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name   string
+		at     time.Time
+		skew   int
+		wantOK bool
+	}{
+		{"current step", now, 1, true},
+		{"previous step within skew", now.Add(-Period * time.Second), 1, true},
+		{"next step within skew", now.Add(Period * time.Second), 1, true},
+		{"two steps back outside skew", now.Add(-2 * Period * time.Second), 1, false},
+		{"previous step without skew", now.Add(-Period * time.Second), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := GenerateCode(secret, Counter(tt.at), Digits)
+			counter, ok := Validate(secret, code, now, tt.skew)
+			if ok != tt.wantOK {
+				t.Fatalf("Validate() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && counter != Counter(tt.at) {
+				t.Errorf("Validate() counter = %d, want %d", counter, Counter(tt.at))
+			}
+		})
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Error("Validate() accepted a code of the wrong length")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("BIO", "alice@example.com", []byte("12345678901234567890"))
+	if !strings.HasPrefix(uri, "otpauth://totp/BIO:alice@example.com?") {
+		t.Errorf("URI() = %s, wrong prefix", uri)
+	}
+	for _, part := range []string{"secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", "issuer=BIO", "digits=6", "period=30"} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("URI() = %s, missing %s", uri, part)
+		}
+	}
+}
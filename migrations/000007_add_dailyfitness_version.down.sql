@@ -0,0 +1,3 @@
+-- Filename: migrations/000007_add_dailyfitness_version.down.sql
+
+ALTER TABLE dailyfitness DROP COLUMN IF EXISTS version;
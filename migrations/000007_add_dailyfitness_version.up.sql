@@ -0,0 +1,3 @@
+-- Filename: migrations/000007_add_dailyfitness_version.up.sql
+
+ALTER TABLE dailyfitness ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
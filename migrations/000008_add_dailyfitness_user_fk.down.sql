@@ -0,0 +1,11 @@
+-- Filename: migrations/000008_add_dailyfitness_user_fk.down.sql
+
+DELETE FROM permissions WHERE code = 'dailyfitness:admin';
+
+ALTER TABLE dailyfitness DROP CONSTRAINT IF EXISTS dailyfitness_user_id_fkey;
+ALTER TABLE dailyfitness ALTER COLUMN user_id TYPE integer;
+
+-- put the quarantined records back where they came from
+INSERT INTO dailyfitness (id, user_id, steps, cups, date)
+SELECT id, user_id, steps, cups, date FROM dailyfitness_orphans;
+DROP TABLE IF EXISTS dailyfitness_orphans;
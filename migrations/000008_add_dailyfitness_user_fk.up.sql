@@ -0,0 +1,22 @@
+-- Filename: migrations/000008_add_dailyfitness_user_fk.up.sql
+
+-- records that belong to no user cannot satisfy the foreign key, so they are
+-- moved aside for an operator to look at rather than thrown away
+CREATE TABLE IF NOT EXISTS dailyfitness_orphans (LIKE dailyfitness INCLUDING DEFAULTS);
+ALTER TABLE dailyfitness_orphans ADD COLUMN IF NOT EXISTS quarantined_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+WITH orphans AS (
+    DELETE FROM dailyfitness
+    WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id = dailyfitness.user_id)
+    RETURNING *
+)
+INSERT INTO dailyfitness_orphans (id, user_id, steps, cups, date)
+SELECT id, user_id, steps, cups, date FROM orphans;
+
+ALTER TABLE dailyfitness ALTER COLUMN user_id TYPE bigint;
+ALTER TABLE dailyfitness ADD CONSTRAINT dailyfitness_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+
+INSERT INTO permissions (code)
+VALUES
+('dailyfitness:admin');
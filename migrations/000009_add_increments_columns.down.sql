@@ -0,0 +1,20 @@
+-- Filename: migrations/000009_add_increments_columns.down.sql
+
+DROP INDEX IF EXISTS tempcups_user_id_created_at_idx;
+ALTER TABLE tempcups DROP COLUMN IF EXISTS created_at;
+ALTER TABLE tempcups DROP CONSTRAINT IF EXISTS tempcups_user_id_fkey;
+ALTER TABLE tempcups ALTER COLUMN user_id TYPE integer;
+
+DROP INDEX IF EXISTS tempsteps_user_id_created_at_idx;
+ALTER TABLE tempsteps DROP COLUMN IF EXISTS created_at;
+ALTER TABLE tempsteps DROP CONSTRAINT IF EXISTS tempsteps_user_id_fkey;
+ALTER TABLE tempsteps ALTER COLUMN user_id TYPE integer;
+
+-- put the quarantined increments back where they came from
+INSERT INTO tempcups (id, user_id, cups)
+SELECT id, user_id, cups FROM tempcups_orphans;
+DROP TABLE IF EXISTS tempcups_orphans;
+
+INSERT INTO tempsteps (id, user_id, steps)
+SELECT id, user_id, steps FROM tempsteps_orphans;
+DROP TABLE IF EXISTS tempsteps_orphans;
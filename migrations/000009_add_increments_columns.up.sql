@@ -0,0 +1,35 @@
+-- Filename: migrations/000009_add_increments_columns.up.sql
+
+-- increments that belong to no user are quarantined the same way as the
+-- dailyfitness records in 000008 instead of being thrown away
+CREATE TABLE IF NOT EXISTS tempsteps_orphans (LIKE tempsteps INCLUDING DEFAULTS);
+ALTER TABLE tempsteps_orphans ADD COLUMN IF NOT EXISTS quarantined_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+WITH orphans AS (
+    DELETE FROM tempsteps
+    WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id = tempsteps.user_id)
+    RETURNING *
+)
+INSERT INTO tempsteps_orphans (id, user_id, steps)
+SELECT id, user_id, steps FROM orphans;
+
+CREATE TABLE IF NOT EXISTS tempcups_orphans (LIKE tempcups INCLUDING DEFAULTS);
+ALTER TABLE tempcups_orphans ADD COLUMN IF NOT EXISTS quarantined_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+WITH orphans AS (
+    DELETE FROM tempcups
+    WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id = tempcups.user_id)
+    RETURNING *
+)
+INSERT INTO tempcups_orphans (id, user_id, cups)
+SELECT id, user_id, cups FROM orphans;
+
+ALTER TABLE tempsteps ALTER COLUMN user_id TYPE bigint;
+ALTER TABLE tempsteps ADD CONSTRAINT tempsteps_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE tempsteps ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS tempsteps_user_id_created_at_idx ON tempsteps (user_id, created_at);
+
+ALTER TABLE tempcups ALTER COLUMN user_id TYPE bigint;
+ALTER TABLE tempcups ADD CONSTRAINT tempcups_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE tempcups ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS tempcups_user_id_created_at_idx ON tempcups (user_id, created_at);
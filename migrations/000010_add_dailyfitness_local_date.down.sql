@@ -0,0 +1,10 @@
+-- Filename: migrations/000010_add_dailyfitness_local_date.down.sql
+
+ALTER TABLE dailyfitness DROP CONSTRAINT IF EXISTS dailyfitness_user_id_local_date_key;
+
+-- put the quarantined duplicates back where they came from
+INSERT INTO dailyfitness (id, user_id, steps, cups, date, version, local_date)
+SELECT id, user_id, steps, cups, date, version, local_date FROM dailyfitness_duplicates;
+DROP TABLE IF EXISTS dailyfitness_duplicates;
+
+ALTER TABLE dailyfitness DROP COLUMN IF EXISTS local_date;
@@ -0,0 +1,31 @@
+-- Filename: migrations/000010_add_dailyfitness_local_date.up.sql
+
+-- local_date is the calendar day that the record counts towards
+ALTER TABLE dailyfitness ADD COLUMN IF NOT EXISTS local_date date;
+UPDATE dailyfitness SET local_date = (date AT TIME ZONE 'UTC')::date;
+ALTER TABLE dailyfitness ALTER COLUMN local_date SET NOT NULL;
+
+-- a day with several records keeps only the latest one, which is the value
+-- the client last reported for that day. The others are moved aside for an
+-- operator to look at, the same way 000008 quarantines orphaned records
+CREATE TABLE IF NOT EXISTS dailyfitness_duplicates (LIKE dailyfitness INCLUDING DEFAULTS);
+ALTER TABLE dailyfitness_duplicates ADD COLUMN IF NOT EXISTS quarantined_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+WITH duplicates AS (
+    DELETE FROM dailyfitness
+    WHERE id IN (
+        SELECT id FROM (
+            SELECT id, ROW_NUMBER() OVER (
+                PARTITION BY user_id, local_date
+                ORDER BY date DESC, id DESC
+            ) AS position
+            FROM dailyfitness
+        ) AS ranked
+        WHERE ranked.position > 1
+    )
+    RETURNING *
+)
+INSERT INTO dailyfitness_duplicates (id, user_id, steps, cups, date, version, local_date)
+SELECT id, user_id, steps, cups, date, version, local_date FROM duplicates;
+
+ALTER TABLE dailyfitness ADD CONSTRAINT dailyfitness_user_id_local_date_key UNIQUE (user_id, local_date);
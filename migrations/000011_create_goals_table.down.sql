@@ -0,0 +1,3 @@
+-- Filename: migrations/000011_create_goals_table.down.sql
+
+DROP TABLE IF EXISTS goals;
@@ -0,0 +1,13 @@
+-- Filename: migrations/000011_create_goals_table.up.sql
+
+-- a goal applies from its effective date until the next goal takes over, so
+-- changing a goal leaves the history of earlier days untouched
+CREATE TABLE IF NOT EXISTS goals (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    steps integer NOT NULL,
+    cups integer NOT NULL,
+    effective_from date NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, effective_from)
+);
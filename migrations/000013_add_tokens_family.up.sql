@@ -0,0 +1,7 @@
+-- Filename: migrations/000013_add_tokens_family.up.sql
+
+-- tokens issued from the same login share a family, so that a replayed
+-- refresh token can revoke everything that descends from it
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family <> '';
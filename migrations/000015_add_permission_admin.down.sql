@@ -0,0 +1,5 @@
+-- Filename: migrations/000015_add_permission_admin.down.sql
+
+DELETE FROM permissions WHERE code = 'permissions:admin';
+
+ALTER TABLE permissions DROP CONSTRAINT IF EXISTS permissions_code_key;
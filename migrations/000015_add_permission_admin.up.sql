@@ -0,0 +1,30 @@
+-- Filename: migrations/000015_add_permission_admin.up.sql
+
+-- merge any duplicate codes into the oldest row before making them unique.
+-- Grants of a duplicate move to the surviving row first, as deleting the
+-- duplicate would otherwise cascade to users_permissions and drop them
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users_permissions.user_id, survivor.id
+FROM users_permissions
+INNER JOIN permissions duplicate ON duplicate.id = users_permissions.permission_id
+INNER JOIN (
+    SELECT code, MIN(id) AS id FROM permissions GROUP BY code
+) AS survivor ON survivor.code = duplicate.code AND survivor.id < duplicate.id
+ON CONFLICT DO NOTHING;
+
+DELETE FROM permissions a USING permissions b
+WHERE a.code = b.code AND a.id > b.id;
+
+ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+
+INSERT INTO permissions (code)
+VALUES
+('permissions:admin')
+ON CONFLICT (code) DO NOTHING;
+
+-- existing users were signed up without the default permissions
+INSERT INTO users_permissions
+SELECT users.id, permissions.id
+FROM users CROSS JOIN permissions
+WHERE permissions.code IN ('dailyfitness:read', 'dailyfitness:write')
+ON CONFLICT DO NOTHING;
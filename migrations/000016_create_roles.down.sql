@@ -0,0 +1,15 @@
+-- Filename: migrations/000016_create_roles.down.sql
+
+-- give the athletes back the default permissions as direct grants
+INSERT INTO users_permissions
+SELECT users_roles.user_id, permissions.id
+FROM users_roles
+INNER JOIN roles ON roles.id = users_roles.role_id
+CROSS JOIN permissions
+WHERE roles.name = 'athlete'
+AND permissions.code IN ('dailyfitness:read', 'dailyfitness:write')
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,44 @@
+-- Filename: migrations/000016_create_roles.up.sql
+
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+-- a role is a named bundle of permission codes
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY(role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY(user_id, role_id)
+);
+
+-- a coach role is left out until there is a permission that sets coaches
+-- apart from athletes
+INSERT INTO roles (name)
+VALUES
+('athlete'), ('admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles CROSS JOIN permissions
+WHERE (roles.name = 'athlete' AND permissions.code IN ('dailyfitness:read', 'dailyfitness:write'))
+OR roles.name = 'admin';
+
+-- every existing user is an athlete, as new users will be
+INSERT INTO users_roles
+SELECT users.id, roles.id
+FROM users CROSS JOIN roles
+WHERE roles.name = 'athlete';
+
+-- the default permissions now come from the athlete role, so the direct
+-- grants 000015 handed out to everyone are redundant
+DELETE FROM users_permissions
+USING permissions
+WHERE users_permissions.permission_id = permissions.id
+AND permissions.code IN ('dailyfitness:read', 'dailyfitness:write');
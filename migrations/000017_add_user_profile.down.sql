@@ -0,0 +1,7 @@
+-- Filename: migrations/000017_add_user_profile.down.sql
+
+ALTER TABLE users DROP COLUMN IF EXISTS units;
+ALTER TABLE users DROP COLUMN IF EXISTS time_zone;
+ALTER TABLE users DROP COLUMN IF EXISTS birth_date;
+ALTER TABLE users DROP COLUMN IF EXISTS weight_kg;
+ALTER TABLE users DROP COLUMN IF EXISTS height_cm;
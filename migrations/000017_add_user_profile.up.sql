@@ -0,0 +1,11 @@
+-- Filename: migrations/000017_add_user_profile.up.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS height_cm numeric(4, 1);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS weight_kg numeric(4, 1);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS birth_date date;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS time_zone text NOT NULL DEFAULT 'UTC';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS units text NOT NULL DEFAULT 'metric';
+
+ALTER TABLE users ADD CONSTRAINT users_height_cm_check CHECK (height_cm BETWEEN 30 AND 300);
+ALTER TABLE users ADD CONSTRAINT users_weight_kg_check CHECK (weight_kg BETWEEN 2 AND 700);
+ALTER TABLE users ADD CONSTRAINT users_units_check CHECK (units IN ('metric', 'imperial'));
@@ -0,0 +1,5 @@
+-- Filename: migrations/000018_add_tokens_email.down.sql
+
+DELETE FROM tokens WHERE scope = 'email-change';
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS email;
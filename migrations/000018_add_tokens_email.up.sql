@@ -0,0 +1,4 @@
+-- Filename: migrations/000018_add_tokens_email.up.sql
+
+-- the address an email-change token will move the account to
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS email citext;
@@ -0,0 +1,5 @@
+-- Filename: migrations/000019_add_users_deleted_at.down.sql
+
+DROP INDEX IF EXISTS users_deleted_at_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
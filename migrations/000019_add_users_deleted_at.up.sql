@@ -0,0 +1,6 @@
+-- Filename: migrations/000019_add_users_deleted_at.up.sql
+
+-- a deleted account is kept for a grace period before it is purged
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Filename: migrations/000020_create_login_failures_table.down.sql
+
+DROP TABLE IF EXISTS login_failures;
@@ -0,0 +1,11 @@
+-- Filename: migrations/000020_create_login_failures_table.up.sql
+
+-- failed logins are tracked per email address so every API instance sees them;
+-- addresses without an account are tracked too, so they cannot be told apart.
+-- The times keep microseconds so that backoffs of a second are not rounded away
+CREATE TABLE IF NOT EXISTS login_failures (
+    email citext PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(6) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(6) with time zone
+);
@@ -0,0 +1,6 @@
+-- Filename: migrations/000021_create_totp_tables.down.sql
+
+DELETE FROM tokens WHERE scope = 'totp-challenge';
+
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS totp;
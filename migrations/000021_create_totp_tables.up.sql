@@ -0,0 +1,18 @@
+-- Filename: migrations/000021_create_totp_tables.up.sql
+
+-- a secret is only used for logins once it has been confirmed with a code
+CREATE TABLE IF NOT EXISTS totp (
+    user_id bigint PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret bytea NOT NULL,
+    confirmed bool NOT NULL DEFAULT false,
+    last_counter bigint NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    used_at timestamp(0) with time zone,
+    UNIQUE (user_id, hash)
+);
@@ -0,0 +1,3 @@
+-- Filename: migrations/000022_create_rate_limits_table.down.sql
+
+DROP TABLE IF EXISTS rate_limits;
@@ -0,0 +1,12 @@
+-- Filename: migrations/000022_create_rate_limits_table.up.sql
+
+-- token buckets shared by every API instance
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    -- whether the request that last updated the bucket was let through
+    allowed boolean NOT NULL DEFAULT true
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_updated_at_idx ON rate_limits (updated_at);